@@ -51,27 +51,39 @@ func searchEngine(engineFunc searchEngineFunc) htmlMapper {
 	}
 }
 
+var searchURLs = map[string]string{
+	"google":   "https://google.com/search?q=%s",
+	"bing":     "https://bing.com/search?q=%s",
+	"bilibili": "https://search.bilibili.com/all?keyword=%s",
+	"github":   "https://github.com/search?q=%s",
+}
+
+// SearchURL returns search result url of keyword in search engine.
+func SearchURL(engine, keyword string) (string, bool) {
+	u, ok := searchURLs[engine]
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprintf(u, url.QueryEscape(keyword)), true
+}
+
 func google(cmd string) string {
-	query := url.QueryEscape(cmd)
-	website := fmt.Sprintf("https://google.com/search?q=%s", query)
+	website, _ := SearchURL("google", cmd)
 	return fmt.Sprintf("谷歌的搜索结果~: <a href=\"%s\">%s</a>", website, cmd)
 }
 
 func bing(cmd string) string {
-	query := url.QueryEscape(cmd)
-	website := fmt.Sprintf("https://bing.com/search?q=%s", query)
+	website, _ := SearchURL("bing", cmd)
 	return fmt.Sprintf("必应的搜索结果~: <a href=\"%s\">%s</a>", website, cmd)
 }
 
 func bilibili(cmd string) string {
-	query := url.QueryEscape(cmd)
-	website := fmt.Sprintf("https://search.bilibili.com/all?keyword=%s", query)
+	website, _ := SearchURL("bilibili", cmd)
 	return fmt.Sprintf("哔哩哔哩🍻~: <a href=\"%s\">%s</a>", website, cmd)
 }
 
 func github(cmd string) string {
-	query := url.QueryEscape(cmd)
-	website := fmt.Sprintf("https://github.com/search?q=%s", query)
+	website, _ := SearchURL("github", cmd)
 	return fmt.Sprintf("🐙🐱 Github: <a href=\"%s\">%s</a>", website, cmd)
 }
 
@@ -73,9 +73,21 @@ func runTimerTask(task *store.Task) {
 	}
 }
 
+// AddTimerTask adds a task to remind user after delay.
+func AddTimerTask(user *User, chatID int64, info string, delay time.Duration) {
+	now := time.Now()
+	timerTaskRunner.AddTask(&store.Task{
+		User:     user.Username,
+		UserId:   user.ID,
+		ChatId:   chatID,
+		Info:     info,
+		ExecTime: now.Add(delay).UnixMilli(),
+		SetTime:  now.UnixMilli(),
+	})
+}
+
 // RunTask can run a task.
 func RunTask(ctx Context) error {
-	now := time.Now()
 	text := "你嗦啥，我听不太懂欸……"
 
 	msg := ctx.Message()
@@ -90,14 +102,7 @@ func RunTask(ctx Context) error {
 	// info := cmd.ArgAllInOneFrom(1)
 	info := strings.TrimSpace(rest)
 
-	timerTaskRunner.AddTask(&store.Task{
-		User:     ctx.Sender().Username,
-		UserId:   ctx.Sender().ID,
-		ChatId:   ctx.Chat().ID,
-		Info:     info,
-		ExecTime: now.Add(delay).UnixMilli(),
-		SetTime:  now.UnixMilli(),
-	})
+	AddTimerTask(ctx.Sender(), ctx.Chat().ID, info, delay)
 
 	text = fmt.Sprintf("好的, 在 %v 后我会来叫你…… <code>%s</code> , 嗯, 不愧是我。", delay, html.EscapeString(info))
 	return ctx.Reply(text, ModeHTML)
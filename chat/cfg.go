@@ -0,0 +1,283 @@
+package chat
+
+import (
+	"csust-got/config"
+	"csust-got/entities"
+	"csust-got/orm"
+	"csust-got/util"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+	. "gopkg.in/telebot.v3"
+)
+
+// Config is the chat config which override global config, it can be set for a chat or a user.
+type Config struct {
+	SystemPrompt string   `json:"system_prompt,omitempty"`
+	Model        string   `json:"model,omitempty"`
+	Temperature  *float32 `json:"temperature,omitempty"`
+	KeepContext  *int     `json:"keep_context,omitempty"`
+
+	AutoTranscribe *bool `json:"auto_transcribe,omitempty"`
+	AutoReply      *bool `json:"auto_reply,omitempty"`
+}
+
+// GetValueByKey get value by key, return global config if not set.
+func (c *Config) GetValueByKey(key string) interface{} {
+	chatCfg := config.BotConfig.ChatConfig
+	switch key {
+	case "system_prompt":
+		if c.SystemPrompt == "" {
+			return chatCfg.SystemPrompt
+		}
+		return c.SystemPrompt
+	case "model":
+		if c.Model == "" {
+			return chatCfg.Model
+		}
+		return c.Model
+	case "temperature":
+		if c.Temperature == nil {
+			return chatCfg.Temperature
+		}
+		return *c.Temperature
+	case "keep_context":
+		if c.KeepContext == nil {
+			return chatCfg.KeepContext
+		}
+		return *c.KeepContext
+	case "auto_transcribe":
+		if c.AutoTranscribe == nil {
+			return false
+		}
+		return *c.AutoTranscribe
+	case "auto_reply":
+		if c.AutoReply == nil {
+			return false
+		}
+		return *c.AutoReply
+	default:
+		return "key not exists"
+	}
+}
+
+// SetValueByKey set config value by key, `*` means reset to global config.
+func (c *Config) SetValueByKey(key string, value string) error {
+	reset := value == "*"
+	switch key {
+	case "system_prompt":
+		if reset {
+			value = ""
+		}
+		c.SystemPrompt = value
+	case "model":
+		if reset {
+			value = ""
+		} else if !isAllowedModel(value) {
+			return fmt.Errorf("%w: model %s is not allowed, available models: %s", ErrConfigIsInvalid,
+				value, strings.Join(config.BotConfig.ChatConfig.AllowedModels, ", "))
+		}
+		c.Model = value
+	case "temperature":
+		if reset {
+			c.Temperature = nil
+			return nil
+		}
+		temperature, err := strconv.ParseFloat(value, 32)
+		if err != nil {
+			return fmt.Errorf("%w: temperature must be a float", ErrConfigIsInvalid)
+		}
+		if temperature < 0 || temperature > 2 {
+			return fmt.Errorf("%w: temperature must be between 0 and 2", ErrConfigIsInvalid)
+		}
+		t := float32(temperature)
+		c.Temperature = &t
+	case "keep_context":
+		if reset {
+			c.KeepContext = nil
+			return nil
+		}
+		keepContext, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%w: keep_context must be a integer", ErrConfigIsInvalid)
+		}
+		if keepContext < 0 || keepContext > 20 {
+			return fmt.Errorf("%w: keep_context too small or too large", ErrConfigIsInvalid)
+		}
+		c.KeepContext = &keepContext
+	case "auto_transcribe":
+		if reset {
+			c.AutoTranscribe = nil
+			return nil
+		}
+		autoTranscribe, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%w: auto_transcribe must be true or false", ErrConfigIsInvalid)
+		}
+		c.AutoTranscribe = &autoTranscribe
+	case "auto_reply":
+		if reset {
+			c.AutoReply = nil
+			return nil
+		}
+		autoReply, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%w: auto_reply must be true or false", ErrConfigIsInvalid)
+		}
+		c.AutoReply = &autoReply
+	default:
+		return fmt.Errorf("%w: invalid key: %s", ErrConfigIsInvalid, key)
+	}
+	return nil
+}
+
+// Merge override config by `o`, only the value set in `o` will be used.
+func (c *Config) Merge(o *Config) {
+	if o.SystemPrompt != "" {
+		c.SystemPrompt = o.SystemPrompt
+	}
+	if o.Model != "" {
+		c.Model = o.Model
+	}
+	if o.Temperature != nil {
+		c.Temperature = o.Temperature
+	}
+	if o.KeepContext != nil {
+		c.KeepContext = o.KeepContext
+	}
+	if o.AutoTranscribe != nil {
+		c.AutoTranscribe = o.AutoTranscribe
+	}
+	if o.AutoReply != nil {
+		c.AutoReply = o.AutoReply
+	}
+}
+
+const cfgHelpInfo = "chatcfg \\[\\-u\\] set \\<key\\> \\<value\\>\n" +
+	"chatcfg \\[\\-u\\] get \\<key\\>\n" +
+	"config is for current chat by default, and only admin can set it in group, " +
+	"use `\\-u` to set your own config, which has higher priority\\.\n" +
+	"use `*` as value to reset to default\\.\n" +
+	"available keys: \n" +
+	"`system_prompt`: system prompt, the persona of bot\\.\n" +
+	"`model`: model of large language model, must be one of `allowed_models`\\.\n" +
+	"`temperature`: temperature between 0 and 2\\.\n" +
+	"`keep_context`: how many rounds of conversation to keep, 0 means no context\\.\n" +
+	"`auto_transcribe`: transcribe voice messages automatically, true or false, only works for chat\\.\n" +
+	"`auto_reply`: chat when bot is mentioned or its answer is replied, true or false, only works for chat\\."
+
+// chatOnlyKeys are keys which only work for chat, they can't be set by user.
+var chatOnlyKeys = map[string]bool{
+	"auto_transcribe": true,
+	"auto_reply":      true,
+}
+
+const (
+	cfgSubCmdSet = "set"
+	cfgSubCmdGet = "get"
+	cfgUserScope = "-u"
+)
+
+// ConfigHandler handle /chatcfg command.
+func ConfigHandler(ctx Context) error {
+	command := entities.FromMessage(ctx.Message())
+
+	args := command.MultiArgsFrom(0)
+	offset := 0
+	userScope := len(args) > 0 && args[0] == cfgUserScope
+	if userScope {
+		offset = 1
+		args = args[1:]
+	}
+	if len(args) < 2 {
+		return ctx.Reply(cfgHelpInfo, ModeMarkdownV2)
+	}
+
+	var cfg *Config
+	var err error
+	if userScope {
+		cfg, err = getUserConfig(ctx.Sender().ID)
+	} else {
+		cfg, err = getChatConfig(ctx.Chat().ID)
+	}
+	if err != nil {
+		return ctx.Reply("完了，删库跑路了")
+	}
+
+	key := args[1]
+	switch args[0] {
+	case cfgSubCmdGet:
+		return ctx.Reply(fmt.Sprintf("%s: %v", key, cfg.GetValueByKey(key)))
+	case cfgSubCmdSet:
+		if len(args) < 3 {
+			return ctx.Reply(cfgHelpInfo, ModeMarkdownV2)
+		}
+		if userScope && chatOnlyKeys[key] {
+			return ctx.Reply(fmt.Sprintf("`%s` 只能给群设置，不能用 `-u` 哦", key), ModeMarkdownV2)
+		}
+		if !userScope && ctx.Chat().Type != ChatPrivate && !util.IsChatAdmin(ctx.Chat(), ctx.Sender()) {
+			return ctx.Reply("只有管理员才能修改本群的配置哦，可以用 `-u` 修改你自己的配置", ModeMarkdownV2)
+		}
+		_, value, err := entities.CommandTakeArgs(ctx.Message(), offset+2)
+		if err != nil {
+			return ctx.Reply(cfgHelpInfo, ModeMarkdownV2)
+		}
+		err = cfg.SetValueByKey(key, value)
+		if err != nil {
+			return ctx.Reply(err.Error())
+		}
+		configStr, err := json.Marshal(cfg)
+		if err != nil {
+			return ctx.Reply("感觉有点问题")
+		}
+		if userScope {
+			err = orm.SetUserChatConfig(ctx.Sender().ID, string(configStr))
+		} else {
+			err = orm.SetChatConfig(ctx.Chat().ID, string(configStr))
+		}
+		if err != nil {
+			return ctx.Reply("完了，删库跑路了")
+		}
+		return ctx.Reply("配置保存成功")
+	}
+
+	return ctx.Reply(cfgHelpInfo, ModeMarkdownV2)
+}
+
+func getChatConfig(chatID int64) (*Config, error) {
+	return parseConfig(orm.GetChatConfig(chatID))
+}
+
+func getUserConfig(userID int64) (*Config, error) {
+	return parseConfig(orm.GetUserChatConfig(userID))
+}
+
+func parseConfig(configStr string, err error) (*Config, error) {
+	cfg := &Config{}
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return cfg, err
+	}
+	if err == nil {
+		err = json.Unmarshal([]byte(configStr), cfg)
+		if err != nil {
+			return cfg, err
+		}
+	}
+	return cfg, nil
+}
+
+// loadConfig load config of user in chat, user's config has higher priority than chat's.
+func loadConfig(chatID, userID int64) *Config {
+	cfg := &Config{}
+	if chatCfg, err := getChatConfig(chatID); err == nil {
+		cfg.Merge(chatCfg)
+	}
+	if userCfg, err := getUserConfig(userID); err == nil {
+		cfg.Merge(userCfg)
+	}
+	return cfg
+}
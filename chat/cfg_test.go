@@ -0,0 +1,21 @@
+package chat
+
+import (
+	"csust-got/config"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig_SetModel(t *testing.T) {
+	config.BotConfig = config.NewBotConfig()
+	config.BotConfig.ChatConfig.AllowedModels = []string{"gpt-4o"}
+
+	cfg := &Config{}
+	require.NoError(t, cfg.SetValueByKey("model", "gpt-4o"))
+	require.Equal(t, "gpt-4o", cfg.Model)
+	require.ErrorIs(t, cfg.SetValueByKey("model", "o1-pro"), ErrConfigIsInvalid)
+	require.Equal(t, "gpt-4o", cfg.Model)
+	require.NoError(t, cfg.SetValueByKey("model", "*"))
+	require.Empty(t, cfg.Model)
+}
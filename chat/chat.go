@@ -21,97 +21,225 @@ import (
 	. "gopkg.in/telebot.v3"
 )
 
-var (
-	client   *openai.Client
-	chatChan = make(chan *chatContext, 16)
-)
-
 type chatContext struct {
 	Context
-	req *openai.ChatCompletionRequest
-	msg *Message
+	provider Provider
+	req      *openai.ChatCompletionRequest
+	opts     *chatOptions
+	msg      *Message
+
+	// images are downloaded images in request, url of telegram file -> data url.
+	images map[string]string
+
+	reqCtx  context.Context
+	cancel  context.CancelFunc
+	stateMu sync.Mutex
+	state   taskState
 }
 
 // InitChat init chat service
 func InitChat() {
-	if config.BotConfig.ChatConfig.Key != "" {
-		client = openai.NewClient(config.BotConfig.ChatConfig.Key)
-		go chatService()
+	initProviders()
+	if len(providers) == 0 {
+		return
+	}
+	for i := 0; i < config.BotConfig.ChatConfig.Workers; i++ {
+		go chatWorker()
 	}
 }
 
+// chatOptions are the options of a chat request.
+type chatOptions struct {
+	stream bool
+	// ask means answer with the knowledge base of chat.
+	ask bool
+	// limited is the text checked by prompt limit, it's the user input if prompt is generated from template.
+	limited *string
+	// session is the name of session which context is loaded from, the new turn will be appended to it.
+	session string
+
+	// options below are set by flags of command, override config of chat and user.
+	model        string
+	temperature  *float32
+	systemPrompt *string
+	noContext    bool
+}
+
 // GPTChat is handler for chat with GPT
 func GPTChat(ctx Context) error {
-	return chat(ctx, false)
+	return chat(ctx, &chatOptions{})
 }
 
 // GPTChatWithStream is handler for chat with GPT, and use stream api
 func GPTChatWithStream(ctx Context) error {
-	return chat(ctx, true)
+	return chat(ctx, &chatOptions{stream: true})
 }
 
-func chat(ctx Context, stream bool) error {
-	if client == nil {
-		return nil
-	}
+// Cust is handler for chat with our custom large language model.
+func Cust(ctx Context) error {
+	return chat(ctx, &chatOptions{})
+}
+
+// Ask is handler for chat with knowledge base of chat.
+func Ask(ctx Context) error {
+	return chat(ctx, &chatOptions{ask: true})
+}
 
-	_, arg, err := entities.CommandTakeArgs(ctx.Message(), 0)
+func chat(ctx Context, opts *chatOptions) error {
+	cmd, arg, err := entities.CommandTakeArgs(ctx.Message(), 0)
 	if err != nil {
 		log.Error("[ChatGPT] Can't take args", zap.Error(err))
 		return ctx.Reply("嗦啥呢？")
 	}
+	arg, err = parseChatFlags(arg, opts)
+	if err != nil {
+		return ctx.Reply(err.Error())
+	}
+
+	return startChat(ctx, getProvider(cmd.Name()), arg, opts)
+}
+
+// startChat sends arg to provider as prompt, and reply to message of ctx.
+func startChat(ctx Context, provider Provider, arg string, opts *chatOptions) error {
+	if provider == nil {
+		return nil
+	}
+	image, mime := replyImage(ctx.Message())
 	if len(arg) == 0 {
-		return ctx.Reply("您好，有什么问题可以为您解答吗？")
+		if image == nil {
+			return ctx.Reply("您好，有什么问题可以为您解答吗？")
+		}
+		arg = "这张图片里有什么？"
+	}
+	limited := arg
+	if opts.limited != nil {
+		limited = *opts.limited
 	}
-	if len(arg) > config.BotConfig.ChatConfig.PromptLimit {
+	if countTokens(limited) > config.BotConfig.ChatConfig.PromptLimit {
 		return ctx.Reply("TLDR")
 	}
+	if reason, ok := checkQuota(ctx.Chat().ID, ctx.Sender().ID); !ok {
+		return ctx.Reply(reason)
+	}
 
-	req, err := generateRequest(ctx, arg, stream)
+	req, err := generateRequest(ctx, provider, arg, opts)
+	if errors.Is(err, errEmptyKnowledge) {
+		return ctx.Reply("本群的知识库还是空的，先用 /kb add 添加一些资料吧")
+	}
 	if err != nil {
-		return err
+		log.Error("[ChatGPT] Can't generate request", zap.Error(err))
+		return ctx.Reply("感觉有点问题")
+	}
+	images := make(map[string]string)
+	if image != nil {
+		if !isVisionModel(req.Model) {
+			return ctx.Reply("当前模型看不了图片哦")
+		}
+		imageURL, err := downloadImage(image, mime)
+		if errors.Is(err, errImageTooLarge) {
+			return ctx.Reply("图片太大了，看不过来")
+		}
+		if err != nil {
+			log.Error("[ChatGPT] Can't download image", zap.Error(err))
+			return ctx.Reply("图片下载失败了")
+		}
+		// image is saved in context as telegram file, downloaded one is used for this request
+		attachImage(req, imageFileURL(image, mime))
+		images[imageFileURL(image, mime)] = imageURL
 	}
 
-	msg, err := util.SendReplyWithError(ctx.Chat(), "正在思考...", ctx.Message())
+	msg, err := util.SendReplyWithError(ctx.Chat(), "正在排队...", ctx.Message())
 	if err != nil {
 		return err
 	}
 
-	payload := &chatContext{Context: ctx, req: req, msg: msg}
+	reqCtx, cancel := context.WithCancel(context.Background())
+	payload := &chatContext{Context: ctx, provider: provider, req: req, opts: opts, msg: msg, images: images,
+		reqCtx: reqCtx, cancel: cancel}
 
-	select {
-	case chatChan <- payload:
-		return nil
-	default:
-		return ctx.Reply("要处理的对话太多了，要不您稍后再试试？")
+	ahead, err := queue.push(payload)
+	switch {
+	case errors.Is(err, errQueueFull):
+		cancel()
+		_, err = util.EditMessageWithError(msg, "要处理的对话太多了，要不您稍后再试试？")
+		return err
+	case errors.Is(err, errTooManyRequests):
+		cancel()
+		_, err = util.EditMessageWithError(msg, "你还有对话没处理完呢，等一下再问吧，也可以用 /chatcancel 取消")
+		return err
 	}
+	if ahead > 0 {
+		payload.showPosition(ahead)
+	}
+	return nil
 }
 
-func generateRequest(ctx Context, arg string, stream bool) (*openai.ChatCompletionRequest, error) {
+func generateRequest(ctx Context, provider Provider, arg string, opts *chatOptions) (*openai.ChatCompletionRequest, error) {
 	chatCfg := config.BotConfig.ChatConfig
+	cfg := loadConfig(ctx.Chat().ID, ctx.Sender().ID)
 	req := openai.ChatCompletionRequest{
 		Model:       openai.GPT3Dot5Turbo,
 		MaxTokens:   chatCfg.MaxTokens,
 		Messages:    []openai.ChatCompletionMessage{},
-		Stream:      stream,
-		Temperature: chatCfg.Temperature,
+		Stream:      opts.stream,
+		Temperature: cfg.GetValueByKey("temperature").(float32),
 	}
 
-	if chatCfg.Model != "" {
+	if opts.model != "" {
+		req.Model = opts.model
+	} else if cfg.Model != "" && isAllowedModel(cfg.Model) {
+		// model may be saved before it's removed from allowed models
+		req.Model = cfg.Model
+	} else if provider.Model() != "" {
+		req.Model = provider.Model()
+	} else if chatCfg.Model != "" {
 		req.Model = chatCfg.Model
 	}
 
-	if len(req.Messages) == 0 && chatCfg.SystemPrompt != "" {
+	if opts.temperature != nil {
+		req.Temperature = *opts.temperature
+	}
+
+	systemPrompt := cfg.GetValueByKey("system_prompt").(string)
+	if opts.systemPrompt != nil {
+		systemPrompt = *opts.systemPrompt
+	}
+	if systemPrompt != "" {
 		req.Messages = append(req.Messages, openai.ChatCompletionMessage{
 			Role:    openai.ChatMessageRoleSystem,
-			Content: chatCfg.SystemPrompt,
+			Content: systemPrompt,
 		})
 	}
 
-	keepContext := chatCfg.KeepContext
-	if keepContext > 0 && ctx.Message().ReplyTo != nil {
-		chatContext, err := orm.GetChatContext(ctx.Chat().ID, ctx.Message().ReplyTo.ID)
-		if err == nil {
+	if opts.ask {
+		chunks, err := retrieveKnowledge(ctx.Chat().ID, ctx.Sender().ID, arg)
+		if err != nil {
+			return nil, err
+		}
+		req.Messages = append(req.Messages, knowledgeMessage(chunks))
+	}
+
+	keepContext := cfg.GetValueByKey("keep_context").(int)
+	if keepContext > 0 && !opts.noContext {
+		// reply chain has higher priority than session
+		var chatContext []openai.ChatCompletionMessage
+		found := false
+		if ctx.Message().ReplyTo != nil {
+			var err error
+			chatContext, err = orm.GetChatContext(ctx.Chat().ID, ctx.Message().ReplyTo.ID)
+			found = err == nil
+		}
+		if !found {
+			if s := activeSession(ctx.Chat().ID, ctx.Sender().ID); s != nil {
+				chatContext, found = s.Messages, true
+				opts.session = s.Name
+			}
+		}
+		if found {
+			if len(chatContext) > 0 && isSummary(&chatContext[0]) {
+				req.Messages = append(req.Messages, chatContext[0])
+				chatContext = chatContext[1:]
+			}
 			if len(chatContext) > 2*keepContext {
 				chatContext = chatContext[len(chatContext)-2*keepContext:]
 			}
@@ -121,25 +249,43 @@ func generateRequest(ctx Context, arg string, stream bool) (*openai.ChatCompleti
 
 	req.Messages = append(req.Messages, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: arg})
 
+	// images in context can only be sent to vision model
+	if !isVisionModel(req.Model) {
+		req.Messages = stripImages(req.Messages)
+	}
+
+	// tool calls in stream are not supported yet, so streamed reply keeps streaming without tools
+	if tools := enabledTools(); len(tools) > 0 && !req.Stream {
+		req.Tools = tools
+	}
+
 	return &req, nil
 }
 
-func chatService() {
-	for ctx := range chatChan {
-		go func(ctx *chatContext) {
-			defer func() {
-				if err := recover(); err != nil {
-					log.Error("[ChatGPT] Panic", zap.Any("err", err))
-				}
-			}()
+func handleChat(ctx *chatContext) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Error("[ChatGPT] Panic", zap.Any("err", err))
+		}
+	}()
+	defer ctx.cancel()
 
-			if ctx.req.Stream {
-				chatWithStream(ctx)
-			} else {
-				chatWithoutStream(ctx)
-			}
+	if !ctx.startTask() {
+		return
+	}
 
-		}(ctx)
+	if !fitContext(ctx) {
+		_, err := util.EditMessageWithError(ctx.msg, "TLDR")
+		if err != nil {
+			log.Error("[ChatGPT] Can't edit message", zap.Error(err))
+		}
+		return
+	}
+
+	if ctx.req.Stream {
+		chatWithStream(ctx)
+	} else {
+		chatWithoutStream(ctx)
 	}
 }
 
@@ -157,6 +303,13 @@ func extractStatusCode(err error) int {
 }
 
 func handleStreamError(ctx *chatContext, err error) bool {
+	if ctx.canceled() {
+		_, err = util.EditMessageWithError(ctx.msg, "已取消")
+		if err != nil {
+			log.Error("[ChatGPT] Can't edit message", zap.Error(err))
+		}
+		return false
+	}
 	statusCode := extractStatusCode(err)
 	if statusCode == 429 { // 错误代码为429
 		log.Debug("[ChatGPT] Rate limit exceeded, retrying...", zap.Error(err))
@@ -171,37 +324,65 @@ func handleStreamError(ctx *chatContext, err error) bool {
 
 }
 
+// retryExhausted edits reply when every retry is rate limited.
+func retryExhausted(ctx *chatContext) {
+	msg := "问的人太多了，等会再试试吧"
+	if ctx.canceled() {
+		msg = "已取消"
+	}
+	if _, err := util.EditMessageWithError(ctx.msg, msg); err != nil {
+		log.Error("[ChatGPT] Can't edit message", zap.Error(err))
+	}
+}
+
+// request returns the request to send, images of telegram file in messages are downloaded.
+func (ctx *chatContext) request() openai.ChatCompletionRequest {
+	req := *ctx.req
+	req.Messages = loadImages(req.Messages, ctx.images)
+	return req
+}
+
 func chatWithStream(ctx *chatContext) {
 	start := time.Now()
 
 	retryNums := config.BotConfig.ChatConfig.RetryNums
 	retryInterval := config.BotConfig.ChatConfig.RetryInterval
 
-	var replyMsg *Message
-	var stream *openai.ChatCompletionStream
+	var stream Stream
 	var err error
 
+	req := ctx.request()
 	// 重试5次，每次间隔1s
 	for i := 0; i < retryNums; i++ {
 		log.Debug("[ChatGPT] retry", zap.Int("retry", i), zap.String("content", ctx.req.Messages[len(ctx.req.Messages)-1].Content))
-		stream, err = client.CreateChatCompletionStream(context.Background(), *ctx.req)
+		stream, err = ctx.provider.CreateChatCompletionStream(ctx.reqCtx, req)
 		if err == nil {
 			log.Debug("[ChatGPT] Create stream successfully", zap.Duration("duration", time.Since(start)))
 			break // 如果成功创建stream，跳出循环
 		}
 		if handleStreamError(ctx, err) {
-			time.Sleep(time.Duration(retryInterval) * time.Second) // retryInterval 秒后重试
+			// retryInterval 秒后重试
+			select {
+			case <-time.After(time.Duration(retryInterval) * time.Second):
+			case <-ctx.reqCtx.Done():
+			}
 			continue
 		}
 		return
 	}
+	if stream == nil {
+		retryExhausted(ctx)
+		return
+	}
 
-	defer stream.Close()
+	defer func() { _ = stream.Close() }()
 
+	promptMessages := ctx.req.Messages
 	content := ""
 	contentLock := sync.Mutex{}
 	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		for {
 			response, err := stream.Recv()
 			if errors.Is(err, io.EOF) {
@@ -209,39 +390,41 @@ func chatWithStream(ctx *chatContext) {
 					Role:    openai.ChatMessageRoleAssistant,
 					Content: content,
 				})
-				done <- struct{}{}
 				break
 			}
 
 			if err != nil {
 				contentLock.Lock()
-				content += "\n\n...寄了"
+				if ctx.canceled() {
+					content += "\n\n...已取消"
+				} else {
+					content += "\n\n...寄了"
+					log.Error("[ChatGPT] Stream error", zap.Error(err))
+				}
 				contentLock.Unlock()
-				log.Error("[ChatGPT] Stream error", zap.Error(err))
 				break
 			}
 
+			// some providers send chunks without choice, such as the usage chunk
+			if len(response.Choices) == 0 {
+				continue
+			}
 			contentLock.Lock()
 			content += response.Choices[0].Delta.Content
 			contentLock.Unlock()
 		}
 	}()
 
+	reply := newReplyMessages(ctx.msg)
 	ticker := time.NewTicker(5 * time.Second) // 编辑过快会被tg限流
 	defer ticker.Stop()
-	lastContent := "" // 记录上次编辑的内容，内容相同则不再编辑，避免tg的api返回400
 out:
 	for range ticker.C {
 		contentLock.Lock()
 		contentCopy := content
 		contentLock.Unlock()
-		if len(strings.TrimSpace(contentCopy)) > 0 && strings.TrimSpace(contentCopy) != strings.TrimSpace(lastContent) {
-			replyMsg, err = util.EditMessageWithError(ctx.msg, contentCopy)
-			if err != nil {
-				log.Error("[ChatGPT] Can't edit message", zap.Error(err))
-			} else {
-				lastContent = contentCopy
-			}
+		if err := reply.update(contentCopy); err != nil {
+			log.Error("[ChatGPT] Can't update reply", zap.Error(err))
 		}
 		select {
 		case <-done:
@@ -250,70 +433,119 @@ out:
 		}
 	}
 
-	contentLock.Lock()
+	usage := estimateUsage(promptMessages, content)
+	cost := recordUsage(ctx, &usage)
 	if strings.TrimSpace(content) == "" {
 		content += "\n...嗦不粗话"
 	}
 	if config.BotConfig.DebugMode {
-		content += fmt.Sprintf("\n\ntime cost: %v\n", time.Since(start))
-		replyMsg, err = util.EditMessageWithError(ctx.msg, content)
-		if err != nil {
-			log.Error("[ChatGPT] Can't edit message", zap.Error(err))
-		}
+		content += usageFooter(&usage, cost, true)
+		content += requestFooter(ctx.req, ctx.opts)
+		content += fmt.Sprintf("time cost: %v\n", time.Since(start))
 	}
-	contentLock.Unlock()
-
-	if replyMsg != nil {
-		err = orm.SetChatContext(ctx.Context.Chat().ID, replyMsg.ID, ctx.req.Messages)
-		if err != nil {
-			log.Error("[ChatGPT] Can't set chat context", zap.Error(err))
-		}
+	if err := reply.update(content); err != nil {
+		log.Error("[ChatGPT] Can't update reply", zap.Error(err))
+		return
 	}
+
+	saveContext(ctx, reply.msgs)
 }
+
 func chatWithoutStream(ctx *chatContext) {
 	start := time.Now()
 
-	retryNums := config.BotConfig.ChatConfig.RetryNums
-	retryInterval := config.BotConfig.ChatConfig.RetryInterval
+	var usage openai.Usage
+	estimated := false
+	var content string
+	for round := 0; ; round++ {
+		if round >= maxToolRounds {
+			ctx.req.Tools = nil
+		}
 
-	var resp openai.ChatCompletionResponse
-	var err error
+		resp, ok := createChatCompletion(ctx)
+		if !ok {
+			return
+		}
+		if len(resp.Choices) == 0 {
+			log.Error("[ChatGPT] Empty response", zap.Error(errEmptyResponse))
+			if _, err := util.EditMessageWithError(ctx.msg, "...嗦不粗话"); err != nil {
+				log.Error("[ChatGPT] Can't edit message", zap.Error(err))
+			}
+			return
+		}
 
-	for i := 0; i < retryNums; i++ {
-		resp, err = client.CreateChatCompletion(context.Background(), *ctx.req)
-		if err == nil {
-			break // 如果成功创建stream，跳出循环
+		msg := resp.Choices[0].Message
+		roundUsage := resp.Usage
+		if roundUsage.TotalTokens == 0 {
+			roundUsage, estimated = estimateUsage(ctx.req.Messages, msg.Content), true
 		}
-		if handleStreamError(ctx, err) {
-			time.Sleep(time.Duration(retryInterval) * time.Second) // retryInterval 秒后重试
-			continue
+		usage.PromptTokens += roundUsage.PromptTokens
+		usage.CompletionTokens += roundUsage.CompletionTokens
+		usage.TotalTokens += roundUsage.TotalTokens
+
+		ctx.req.Messages = append(ctx.req.Messages, msg)
+		if len(msg.ToolCalls) == 0 {
+			content = msg.Content
+			break
+		}
+
+		names := make([]string, 0, len(msg.ToolCalls))
+		for i := range msg.ToolCalls {
+			call := &msg.ToolCalls[i]
+			names = append(names, call.Function.Name)
+			ctx.req.Messages = append(ctx.req.Messages, openai.ChatCompletionMessage{
+				Role:       openai.ChatMessageRoleTool,
+				Content:    callTool(ctx, call),
+				ToolCallID: call.ID,
+			})
+		}
+		_, err := util.EditMessageWithError(ctx.msg, fmt.Sprintf("正在使用 %s ...", strings.Join(names, ", ")))
+		if err != nil {
+			log.Error("[ChatGPT] Can't edit message", zap.Error(err))
 		}
-		return
 	}
 
-	content := resp.Choices[0].Message.Content
+	cost := recordUsage(ctx, &usage)
 
 	if strings.TrimSpace(content) == "" {
 		content += "\n...嗦不粗话"
 	}
 
 	if config.BotConfig.DebugMode {
-		content += fmt.Sprintf("\n\nusage: %d + %d = %d\nCredits spent (US$) : \n    %.2f (gpt-4) ; \n    %.3f (gpt-3.5)\n",
-			resp.Usage.PromptTokens,
-			resp.Usage.CompletionTokens,
-			resp.Usage.TotalTokens,
-			(float32(resp.Usage.PromptTokens)*0.03+float32(resp.Usage.CompletionTokens)*0.06)/1000,
-			float32(resp.Usage.TotalTokens)*0.002/1000)
+		content += usageFooter(&usage, cost, estimated)
+		content += requestFooter(ctx.req, ctx.opts)
 		content += fmt.Sprintf("time cost: %v\n", time.Since(start))
 	}
-	replyMsg, err := util.EditMessageWithError(ctx.msg, content)
-	if err != nil {
-		log.Error("[ChatGPT] Can't edit message", zap.Error(err))
+	reply := newReplyMessages(ctx.msg)
+	if err := reply.update(content); err != nil {
+		log.Error("[ChatGPT] Can't update reply", zap.Error(err))
 		return
 	}
 
-	err = orm.SetChatContext(ctx.Context.Chat().ID, replyMsg.ID, ctx.req.Messages)
-	if err != nil {
-		log.Error("[ChatGPT] Can't set chat context", zap.Error(err))
+	saveContext(ctx, reply.msgs)
+}
+
+func createChatCompletion(ctx *chatContext) (resp openai.ChatCompletionResponse, ok bool) {
+	retryNums := config.BotConfig.ChatConfig.RetryNums
+	retryInterval := config.BotConfig.ChatConfig.RetryInterval
+
+	req := ctx.request()
+	var err error
+	for i := 0; i < retryNums; i++ {
+		resp, err = ctx.provider.CreateChatCompletion(ctx.reqCtx, req)
+		if err == nil {
+			return resp, true
+		}
+		if handleStreamError(ctx, err) {
+			// retryInterval 秒后重试
+			select {
+			case <-time.After(time.Duration(retryInterval) * time.Second):
+			case <-ctx.reqCtx.Done():
+			}
+			continue
+		}
+		return resp, false
 	}
+	retryExhausted(ctx)
+	return resp, false
 }
@@ -0,0 +1,149 @@
+package chat
+
+import (
+	"context"
+	"csust-got/config"
+	"csust-got/log"
+	"csust-got/orm"
+	"strings"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	. "gopkg.in/telebot.v3"
+)
+
+// summaryPrefix is the prefix of summary message, summary message is a system message in history.
+const summaryPrefix = "以下是之前对话的摘要：\n"
+
+const summarizePrompt = "请用简洁的语言总结以下对话的要点，保留人名、数字、结论等关键信息，不要添加对话中没有的内容。"
+
+func isSummary(msg *openai.ChatCompletionMessage) bool {
+	return msg.Role == openai.ChatMessageRoleSystem && strings.HasPrefix(msg.Content, summaryPrefix)
+}
+
+// splitMessages splits messages of request into head (system prompt and summary), history and prompt.
+func splitMessages(msgs []openai.ChatCompletionMessage) (head, history []openai.ChatCompletionMessage, prompt openai.ChatCompletionMessage) {
+	prompt = msgs[len(msgs)-1]
+	msgs = msgs[:len(msgs)-1]
+	i := 0
+	for i < len(msgs) && msgs[i].Role == openai.ChatMessageRoleSystem {
+		i++
+	}
+	return msgs[:i], msgs[i:], prompt
+}
+
+// fitContext trims history of request to fit the context window of model, and reserves `MaxTokens` for reply.
+// The oldest turns will be dropped or summarized, returns false if the prompt is too long even without history.
+func fitContext(ctx *chatContext) bool {
+	head, history, prompt := splitMessages(ctx.req.Messages)
+
+	budget := contextWindow(ctx.req.Model) - ctx.req.MaxTokens - countMessagesTokens(head) - countMessageTokens(&prompt)
+	if budget < 0 {
+		return false
+	}
+
+	kept, dropped := trimHistory(history, budget)
+	if len(dropped) > 0 {
+		log.Debug("[ChatGPT] context is too long, drop oldest turns",
+			zap.Int("dropped", len(dropped)), zap.Int("kept", len(kept)))
+		if config.BotConfig.ChatConfig.SummarizeContext {
+			head, kept = summarizeDropped(ctx, head, kept, dropped)
+		}
+	}
+
+	msgs := make([]openai.ChatCompletionMessage, 0, len(head)+len(kept)+1)
+	msgs = append(msgs, head...)
+	msgs = append(msgs, kept...)
+	ctx.req.Messages = append(msgs, prompt)
+	return true
+}
+
+// summarizeDropped summarizes the dropped turns (and the old summary) into a new summary message in head.
+func summarizeDropped(ctx *chatContext, head, kept, dropped []openai.ChatCompletionMessage) ([]openai.ChatCompletionMessage, []openai.ChatCompletionMessage) {
+	newHead := make([]openai.ChatCompletionMessage, 0, len(head)+1)
+	toSummarize := make([]openai.ChatCompletionMessage, 0, len(dropped)+1)
+	for _, msg := range head {
+		if isSummary(&msg) {
+			toSummarize = append(toSummarize, msg)
+		} else {
+			newHead = append(newHead, msg)
+		}
+	}
+	toSummarize = append(toSummarize, dropped...)
+
+	summary, err := summarize(ctx.reqCtx, ctx.provider, ctx.req.Model, toSummarize)
+	if err != nil {
+		log.Error("[ChatGPT] Can't summarize context", zap.Error(err))
+		return head, kept
+	}
+	newHead = append(newHead, openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleSystem,
+		Content: summaryPrefix + summary,
+	})
+
+	// summary takes some tokens, so history may need to be trimmed again.
+	_, _, prompt := splitMessages(ctx.req.Messages)
+	budget := contextWindow(ctx.req.Model) - ctx.req.MaxTokens - countMessagesTokens(newHead) - countMessageTokens(&prompt)
+	if budget < 0 {
+		return head, kept
+	}
+	kept, _ = trimHistory(kept, budget)
+	return newHead, kept
+}
+
+func summarize(reqCtx context.Context, provider Provider, model string, msgs []openai.ChatCompletionMessage) (string, error) {
+	var sb strings.Builder
+	for _, msg := range msgs {
+		if isSummary(&msg) {
+			sb.WriteString(msg.Content)
+		} else {
+			sb.WriteString(msg.Role + ": " + messageText(&msg))
+		}
+		sb.WriteString("\n\n")
+	}
+
+	maxTokens := config.BotConfig.ChatConfig.MaxTokens
+	if maxTokens > 512 {
+		maxTokens = 512
+	}
+	req := openai.ChatCompletionRequest{
+		Model:     model,
+		MaxTokens: maxTokens,
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleSystem, Content: summarizePrompt},
+			{Role: openai.ChatMessageRoleUser, Content: sb.String()},
+		},
+	}
+
+	// request context is used, so that /chatcancel can stop it
+	ctx, cancel := context.WithTimeout(reqCtx, time.Minute)
+	defer cancel()
+	resp, err := provider.CreateChatCompletion(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Choices) == 0 {
+		return "", errEmptyResponse
+	}
+	return strings.TrimSpace(resp.Choices[0].Message.Content), nil
+}
+
+// saveContext saves messages of request as context of reply messages, system prompt will not be saved.
+// Every message of a split reply has the context, so user can reply to any of them to continue.
+func saveContext(ctx *chatContext, replyMsgs []*Message) {
+	// images are saved as telegram files, which are small
+	msgs := ctx.req.Messages
+	for len(msgs) > 0 && msgs[0].Role == openai.ChatMessageRoleSystem && !isSummary(&msgs[0]) {
+		msgs = msgs[1:]
+	}
+	for _, replyMsg := range replyMsgs {
+		err := orm.SetChatContext(ctx.Context.Chat().ID, replyMsg.ID, msgs)
+		if err != nil {
+			log.Error("[ChatGPT] Can't set chat context", zap.Error(err))
+		}
+	}
+	if ctx.opts.session != "" {
+		appendSession(ctx)
+	}
+}
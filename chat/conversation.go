@@ -0,0 +1,56 @@
+package chat
+
+import (
+	"csust-got/config"
+	"csust-got/orm"
+	"strings"
+
+	. "gopkg.in/telebot.v3"
+)
+
+// ConversationHandler continues conversation when bot is mentioned or its answer is replied,
+// it only works in chat which `auto_reply` is enabled.
+func ConversationHandler(ctx Context) error {
+	msg := ctx.Message()
+	if msg == nil || ctx.Sender() == nil || msg.Text == "" || strings.HasPrefix(msg.Text, "/") {
+		return nil
+	}
+	cfg, err := getChatConfig(ctx.Chat().ID)
+	if err != nil || !cfg.GetValueByKey("auto_reply").(bool) {
+		return nil
+	}
+
+	me := config.BotConfig.Bot.Me
+	text, mentioned := stripMention(msg, me)
+	if !mentioned && !isReplyToAnswer(msg, me) {
+		return nil
+	}
+	return startChat(ctx, getProvider(""), strings.TrimSpace(text), &chatOptions{})
+}
+
+// stripMention removes mentions of bot from text of msg, returns whether bot is mentioned.
+func stripMention(msg *Message, me *User) (string, bool) {
+	text := msg.Text
+	mentioned := false
+	for _, e := range msg.Entities {
+		switch {
+		case e.Type == EntityMention && strings.EqualFold(msg.EntityText(e), "@"+me.Username):
+		case e.Type == EntityTMention && e.User != nil && e.User.ID == me.ID:
+		default:
+			continue
+		}
+		mentioned = true
+		text = strings.Replace(text, msg.EntityText(e), "", 1)
+	}
+	return text, mentioned
+}
+
+// isReplyToAnswer reports whether msg replies to an answer of bot, which has context saved.
+func isReplyToAnswer(msg *Message, me *User) bool {
+	replyTo := msg.ReplyTo
+	if replyTo == nil || replyTo.Sender == nil || replyTo.Sender.ID != me.ID {
+		return false
+	}
+	_, err := orm.GetChatContext(msg.Chat.ID, replyTo.ID)
+	return err == nil
+}
@@ -0,0 +1,25 @@
+package chat
+
+import "errors"
+
+// chat error
+var (
+	ErrProviderConfigInvalid = errors.New("provider config is invalid")
+	ErrConfigIsInvalid       = errors.New("config is invalid")
+	ErrNoProvider            = errors.New("no provider is configured")
+	ErrQuotaExceeded         = errors.New("quota is used up")
+
+	errEmptyResponse   = errors.New("response has no choice")
+	errQueueFull       = errors.New("chat queue is full")
+	errTooManyRequests = errors.New("too many requests of user")
+	errImageTooLarge   = errors.New("image is too large")
+
+	errAudioTooLong           = errors.New("audio is too long")
+	errTranscribeNotSupported = errors.New("provider does not support transcription")
+
+	errEmptyKnowledge    = errors.New("knowledge base is empty")
+	errEmbedNotSupported = errors.New("provider does not support embeddings")
+	errKnowledgeTooLarge = errors.New("knowledge is too large")
+
+	errFlagInvalid = errors.New("flag is invalid")
+)
@@ -0,0 +1,110 @@
+package chat
+
+import (
+	"csust-got/config"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// parseChatFlags parses leading flags of prompt into opts, and returns the rest prompt.
+// Parsing stops at the first token which is not a flag, or `--`.
+//
+//	-m, --model <model>        model of this request, must be in `allowed_models`
+//	-t, --temperature <float>  temperature between 0 and 2
+//	-s, --system <prompt>      system prompt of this request, quote it if it contains spaces
+//	-n, --no-context           don't load context of the replied message
+func parseChatFlags(arg string, opts *chatOptions) (string, error) {
+	rest := arg
+	for {
+		token, next := nextToken(rest)
+		switch token {
+		case "--":
+			return strings.TrimSpace(next), nil
+		case "-n", "--no-context":
+			opts.noContext = true
+			rest = next
+			continue
+		case "-m", "--model", "-t", "--temperature", "-s", "--system":
+		default:
+			return strings.TrimSpace(rest), nil
+		}
+
+		if strings.TrimSpace(next) == "" {
+			return "", fmt.Errorf("%w: %s needs a value", errFlagInvalid, token)
+		}
+		value, next := nextToken(next)
+		switch token {
+		case "-m", "--model":
+			if !isAllowedModel(value) {
+				return "", fmt.Errorf("%w: model %s is not allowed", errFlagInvalid, value)
+			}
+			opts.model = value
+		case "-t", "--temperature":
+			temperature, err := strconv.ParseFloat(value, 32)
+			if err != nil || temperature < 0 || temperature > 2 {
+				return "", fmt.Errorf("%w: temperature must be between 0 and 2", errFlagInvalid)
+			}
+			t := float32(temperature)
+			opts.temperature = &t
+		case "-s", "--system":
+			opts.systemPrompt = &value
+		}
+		rest = next
+	}
+}
+
+// nextToken returns the first token of s and the rest, token can be quoted by `"` or `'`.
+func nextToken(s string) (token, rest string) {
+	s = strings.TrimLeftFunc(s, unicode.IsSpace)
+	if s == "" {
+		return "", ""
+	}
+
+	if quote := s[0]; quote == '"' || quote == '\'' {
+		if end := strings.IndexByte(s[1:], quote); end >= 0 {
+			return s[1 : end+1], s[end+2:]
+		}
+	}
+
+	end := strings.IndexFunc(s, unicode.IsSpace)
+	if end < 0 {
+		return s, ""
+	}
+	return s[:end], s[end:]
+}
+
+// isAllowedModel reports whether model can be chosen by user with flag or config.
+func isAllowedModel(model string) bool {
+	for _, m := range config.BotConfig.ChatConfig.AllowedModels {
+		if m == model {
+			return true
+		}
+	}
+	return false
+}
+
+// requestFooter is the request info shown in debug mode, options set by flags are listed.
+func requestFooter(req *openai.ChatCompletionRequest, opts *chatOptions) string {
+	footer := fmt.Sprintf("model: %s, temperature: %.2f", req.Model, req.Temperature)
+	var flags []string
+	if opts.model != "" {
+		flags = append(flags, "-m")
+	}
+	if opts.temperature != nil {
+		flags = append(flags, "-t")
+	}
+	if opts.systemPrompt != nil {
+		flags = append(flags, "-s")
+	}
+	if opts.noContext {
+		flags = append(flags, "--no-context")
+	}
+	if len(flags) > 0 {
+		footer += " (flags: " + strings.Join(flags, " ") + ")"
+	}
+	return footer + "\n"
+}
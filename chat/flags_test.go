@@ -0,0 +1,46 @@
+package chat
+
+import (
+	"csust-got/config"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseChatFlags(t *testing.T) {
+	config.BotConfig = config.NewBotConfig()
+	config.BotConfig.ChatConfig.AllowedModels = []string{"gpt-4o"}
+
+	float32Ptr := func(f float32) *float32 { return &f }
+	stringPtr := func(s string) *string { return &s }
+
+	tests := []struct {
+		arg     string
+		want    string
+		opts    chatOptions
+		wantErr bool
+	}{
+		{arg: "hello world", want: "hello world"},
+		{arg: "-m gpt-4o hello", want: "hello", opts: chatOptions{model: "gpt-4o"}},
+		{arg: "--model gpt-4o -t 0.2 hello", want: "hello", opts: chatOptions{model: "gpt-4o", temperature: float32Ptr(0.2)}},
+		{arg: `-s "you are a translator" 你好`, want: "你好", opts: chatOptions{systemPrompt: stringPtr("you are a translator")}},
+		{arg: "-s '' hi", want: "hi", opts: chatOptions{systemPrompt: stringPtr("")}},
+		{arg: "--no-context -n hi\nthere", want: "hi\nthere", opts: chatOptions{noContext: true}},
+		{arg: "-- -m is a flag", want: "-m is a flag"},
+		{arg: "-1 is negative", want: "-1 is negative"},
+		{arg: "-m gpt-3 hello", wantErr: true},
+		{arg: "-t 3 hello", wantErr: true},
+		{arg: "-t", wantErr: true},
+	}
+	for _, tt := range tests {
+		opts := chatOptions{}
+		got, err := parseChatFlags(tt.arg, &opts)
+		if tt.wantErr {
+			require.ErrorIsf(t, err, errFlagInvalid, "parseChatFlags(%q)", tt.arg)
+			continue
+		}
+		require.NoErrorf(t, err, "parseChatFlags(%q)", tt.arg)
+		require.Equalf(t, tt.want, got, "parseChatFlags(%q)", tt.arg)
+		require.Equalf(t, tt.opts, opts, "parseChatFlags(%q)", tt.arg)
+	}
+}
@@ -0,0 +1,362 @@
+package chat
+
+import (
+	"context"
+	"csust-got/config"
+	"csust-got/entities"
+	"csust-got/log"
+	"csust-got/orm"
+	"csust-got/util"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	openai "github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	. "gopkg.in/telebot.v3"
+)
+
+const (
+	// maxKnowledgeSize is the max size of document added to knowledge base.
+	maxKnowledgeSize = 1 << 20
+	// maxKnowledgeChunks is the max chunks of a document, it limits the cost of adding a document.
+	maxKnowledgeChunks = 256
+	// embedBatchSize is the max texts embedded in one request, providers limit the inputs of a request.
+	embedBatchSize = 64
+)
+
+const knowledgePrompt = "以下是本群知识库中与问题相关的资料，回答时请优先参考这些资料，并注明引用的资料编号，" +
+	"资料中没有的内容请说明是你自己的理解：\n"
+
+// knowledge is a document in knowledge base of chat, it's split into chunks to embed.
+type knowledge struct {
+	ID        int64            `json:"id"`
+	Title     string           `json:"title"`
+	UserID    int64            `json:"user_id"`
+	CreatedAt int64            `json:"created_at"`
+	Chunks    []knowledgeChunk `json:"chunks"`
+}
+
+type knowledgeChunk struct {
+	Text      string    `json:"text"`
+	Embedding []float32 `json:"embedding"`
+}
+
+// scoredChunk is a chunk with its similarity to question.
+type scoredChunk struct {
+	title string
+	text  string
+	score float32
+}
+
+func getEmbedder() (Embedder, error) {
+	chatCfg := config.BotConfig.ChatConfig
+	name := chatCfg.KnowledgeProvider
+	if name == "" {
+		name = chatCfg.Provider
+	}
+	p, ok := providers[name]
+	if !ok {
+		return nil, ErrProviderConfigInvalid
+	}
+	e, ok := p.(Embedder)
+	if !ok {
+		return nil, errEmbedNotSupported
+	}
+	return e, nil
+}
+
+// embed creates embeddings of texts in batches, usage is recorded for user in chat.
+func embed(chatID, userID int64, texts []string) ([][]float32, error) {
+	embedder, err := getEmbedder()
+	if err != nil {
+		return nil, err
+	}
+	embeddings := make([][]float32, 0, len(texts))
+	for start := 0; start < len(texts); start += embedBatchSize {
+		end := start + embedBatchSize
+		if end > len(texts) {
+			end = len(texts)
+		}
+		batch, err := embedBatch(embedder, chatID, userID, texts[start:end])
+		if err != nil {
+			return nil, err
+		}
+		embeddings = append(embeddings, batch...)
+	}
+	return embeddings, nil
+}
+
+func embedBatch(embedder Embedder, chatID, userID int64, texts []string) ([][]float32, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	resp, err := embedder.CreateEmbeddings(ctx, openai.EmbeddingRequestStrings{
+		Input: texts,
+		Model: openai.EmbeddingModel(config.BotConfig.ChatConfig.EmbeddingModel),
+	})
+	if err != nil {
+		return nil, err
+	}
+	addUsage(chatID, userID, config.BotConfig.ChatConfig.EmbeddingModel, &resp.Usage)
+	if len(resp.Data) != len(texts) {
+		return nil, errEmptyResponse
+	}
+	embeddings := make([][]float32, len(texts))
+	for _, data := range resp.Data {
+		if data.Index < 0 || data.Index >= len(texts) {
+			return nil, errEmptyResponse
+		}
+		embeddings[data.Index] = data.Embedding
+	}
+	return embeddings, nil
+}
+
+// cosineSimilarity returns cosine similarity of two vectors, 0 if they have different dimensions.
+func cosineSimilarity(a, b []float32) float32 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return float32(dot / (math.Sqrt(normA) * math.Sqrt(normB)))
+}
+
+// loadKnowledge loads all knowledge of chat, sorted by id.
+func loadKnowledge(chatID int64) ([]*knowledge, error) {
+	res, err := orm.GetKnowledge(chatID)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*knowledge, 0, len(res))
+	for id, s := range res {
+		k := &knowledge{}
+		if err := json.Unmarshal([]byte(s), k); err != nil {
+			log.Error("[ChatGPT] Can't unmarshal knowledge", zap.String("id", id), zap.Error(err))
+			continue
+		}
+		list = append(list, k)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list, nil
+}
+
+// retrieveKnowledge finds the top k chunks which are most relevant to question in knowledge base of chat.
+func retrieveKnowledge(chatID, userID int64, question string) ([]scoredChunk, error) {
+	list, err := loadKnowledge(chatID)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, errEmptyKnowledge
+	}
+	embeddings, err := embed(chatID, userID, []string{question})
+	if err != nil {
+		return nil, err
+	}
+
+	var chunks []scoredChunk
+	for _, k := range list {
+		for _, c := range k.Chunks {
+			chunks = append(chunks, scoredChunk{
+				title: k.Title,
+				text:  c.Text,
+				score: cosineSimilarity(embeddings[0], c.Embedding),
+			})
+		}
+	}
+	sort.SliceStable(chunks, func(i, j int) bool { return chunks[i].score > chunks[j].score })
+	if topK := config.BotConfig.ChatConfig.KnowledgeTopK; len(chunks) > topK {
+		chunks = chunks[:topK]
+	}
+	return chunks, nil
+}
+
+// knowledgeMessage is the system message which contains the retrieved chunks.
+func knowledgeMessage(chunks []scoredChunk) openai.ChatCompletionMessage {
+	var sb strings.Builder
+	sb.WriteString(knowledgePrompt)
+	for i, c := range chunks {
+		sb.WriteString(fmt.Sprintf("\n[%d] %s\n%s\n", i+1, c.title, c.text))
+	}
+	return openai.ChatCompletionMessage{Role: openai.ChatMessageRoleSystem, Content: sb.String()}
+}
+
+const kbHelpInfo = "kb add \\[title\\]: reply to a message or text document to add it to knowledge base\\.\n" +
+	"kb list: list knowledge in this chat\\.\n" +
+	"kb rm \\<id\\>: remove knowledge, only the one who added it or admin can remove it\\.\n" +
+	"use `/ask <question>` to ask with knowledge base\\."
+
+// KnowledgeHandler handle /kb command.
+func KnowledgeHandler(ctx Context) error {
+	command := entities.FromMessage(ctx.Message())
+	switch command.Arg(0) {
+	case "add":
+		return addKnowledge(ctx, command.ArgAllInOneFrom(1))
+	case "list":
+		return listKnowledge(ctx)
+	case "rm":
+		return removeKnowledge(ctx, command.Arg(1))
+	}
+	return ctx.Reply(kbHelpInfo, ModeMarkdownV2)
+}
+
+// replyText returns text of the replied message, text document is downloaded.
+func replyText(msg *Message) (text, title string, err error) {
+	replyTo := msg.ReplyTo
+	if replyTo == nil {
+		return "", "", nil
+	}
+	if doc := replyTo.Document; doc != nil {
+		if !strings.HasPrefix(doc.MIME, "text/") && doc.MIME != "application/json" {
+			return "", "", nil
+		}
+		if doc.FileSize > maxKnowledgeSize {
+			return "", "", errKnowledgeTooLarge
+		}
+		reader, err := config.BotConfig.Bot.File(&doc.File)
+		if err != nil {
+			return "", "", err
+		}
+		defer func() { _ = reader.Close() }()
+		data, err := io.ReadAll(io.LimitReader(reader, maxKnowledgeSize+1))
+		if err != nil {
+			return "", "", err
+		}
+		if len(data) > maxKnowledgeSize {
+			return "", "", errKnowledgeTooLarge
+		}
+		return string(data), doc.FileName, nil
+	}
+	if replyTo.Text != "" {
+		return replyTo.Text, "", nil
+	}
+	return replyTo.Caption, "", nil
+}
+
+func addKnowledge(ctx Context, title string) error {
+	text, docName, err := replyText(ctx.Message())
+	if errors.Is(err, errKnowledgeTooLarge) {
+		return ctx.Reply("文件太大了，塞不进去")
+	}
+	if err != nil {
+		log.Error("[ChatGPT] Can't download document", zap.Error(err))
+		return ctx.Reply("文件下载失败了")
+	}
+	if strings.TrimSpace(text) == "" {
+		return ctx.Reply("请回复一条文字消息或者文本文件")
+	}
+	if title == "" {
+		title = docName
+	}
+	if title == "" {
+		title = strings.TrimSpace(text)
+		if runes := []rune(title); len(runes) > 20 {
+			title = string(runes[:20]) + "..."
+		}
+		title = strings.ReplaceAll(title, "\n", " ")
+	}
+
+	if reason, ok := checkQuota(ctx.Chat().ID, ctx.Sender().ID); !ok {
+		return ctx.Reply(reason)
+	}
+
+	msg, err := util.SendReplyWithError(ctx.Chat(), "正在学习...", ctx.Message())
+	if err != nil {
+		return err
+	}
+
+	chunkTexts := splitMessage(strings.TrimSpace(text), config.BotConfig.ChatConfig.KnowledgeChunkSize)
+	if len(chunkTexts) > maxKnowledgeChunks {
+		_, err = util.EditMessageWithError(msg, fmt.Sprintf("太长了，最多只能学 %d 段，拆开来试试吧", maxKnowledgeChunks))
+		return err
+	}
+	embeddings, err := embed(ctx.Chat().ID, ctx.Sender().ID, chunkTexts)
+	if errors.Is(err, errEmbedNotSupported) || errors.Is(err, ErrProviderConfigInvalid) {
+		_, err = util.EditMessageWithError(msg, "没有配置知识库哦")
+		return err
+	}
+	if err != nil {
+		log.Error("[ChatGPT] Can't create embeddings", zap.Error(err))
+		_, err = util.EditMessageWithError(msg, "学不会，要不等会再试试？")
+		return err
+	}
+
+	chatID := ctx.Chat().ID
+	id, err := orm.NewKnowledgeID(chatID)
+	if err != nil {
+		_, err = util.EditMessageWithError(msg, "完了，删库跑路了")
+		return err
+	}
+	k := &knowledge{ID: id, Title: title, UserID: ctx.Sender().ID, CreatedAt: time.Now().Unix()}
+	for i, chunk := range chunkTexts {
+		k.Chunks = append(k.Chunks, knowledgeChunk{Text: chunk, Embedding: embeddings[i]})
+	}
+	data, err := json.Marshal(k)
+	if err != nil {
+		_, err = util.EditMessageWithError(msg, "感觉有点问题")
+		return err
+	}
+	if err = orm.SetKnowledge(chatID, id, string(data)); err != nil {
+		_, err = util.EditMessageWithError(msg, "完了，删库跑路了")
+		return err
+	}
+	_, err = util.EditMessageWithError(msg, fmt.Sprintf("学会了 #%d %s，共 %d 段", id, title, len(chunkTexts)))
+	return err
+}
+
+func listKnowledge(ctx Context) error {
+	list, err := loadKnowledge(ctx.Chat().ID)
+	if err != nil {
+		return ctx.Reply("完了，删库跑路了")
+	}
+	if len(list) == 0 {
+		return ctx.Reply("本群的知识库还是空的")
+	}
+	var sb strings.Builder
+	sb.WriteString("本群的知识库:\n")
+	for _, k := range list {
+		sb.WriteString(fmt.Sprintf("#%d %s (%d 段, %s)\n", k.ID, k.Title, len(k.Chunks),
+			time.Unix(k.CreatedAt, 0).In(util.TimeZoneCST).Format("2006-01-02")))
+	}
+	return ctx.Reply(sb.String())
+}
+
+func removeKnowledge(ctx Context, idStr string) error {
+	id, err := strconv.ParseInt(strings.TrimPrefix(idStr, "#"), 10, 64)
+	if err != nil {
+		return ctx.Reply(kbHelpInfo, ModeMarkdownV2)
+	}
+	chatID := ctx.Chat().ID
+	s, err := orm.GetKnowledgeByID(chatID, id)
+	if errors.Is(err, redis.Nil) {
+		return ctx.Reply("没有这条知识")
+	}
+	if err != nil {
+		return ctx.Reply("完了，删库跑路了")
+	}
+	k := &knowledge{}
+	if err = json.Unmarshal([]byte(s), k); err != nil {
+		return ctx.Reply("感觉有点问题")
+	}
+	if k.UserID != ctx.Sender().ID && ctx.Chat().Type != ChatPrivate && !util.IsChatAdmin(ctx.Chat(), ctx.Sender()) {
+		return ctx.Reply("只有添加的人或者管理员才能删除哦")
+	}
+	if err = orm.DelKnowledge(chatID, id); err != nil {
+		return ctx.Reply("完了，删库跑路了")
+	}
+	return ctx.Reply(fmt.Sprintf("忘掉了 #%d %s", id, k.Title))
+}
@@ -0,0 +1,25 @@
+package chat
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_cosineSimilarity(t *testing.T) {
+	tests := []struct {
+		a, b []float32
+		want float32
+	}{
+		{[]float32{1, 0}, []float32{1, 0}, 1},
+		{[]float32{1, 0}, []float32{0, 1}, 0},
+		{[]float32{1, 1}, []float32{-1, -1}, -1},
+		{[]float32{1, 2, 3}, []float32{2, 4, 6}, 1},
+		{[]float32{1, 0}, []float32{1, 0, 0}, 0},
+		{[]float32{0, 0}, []float32{1, 0}, 0},
+		{nil, nil, 0},
+	}
+	for _, tt := range tests {
+		require.InDeltaf(t, tt.want, cosineSimilarity(tt.a, tt.b), 1e-6, "cosineSimilarity(%v, %v)", tt.a, tt.b)
+	}
+}
@@ -0,0 +1,191 @@
+package chat
+
+import (
+	"csust-got/entities"
+	"csust-got/log"
+	"csust-got/orm"
+	"csust-got/util"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+	. "gopkg.in/telebot.v3"
+)
+
+const (
+	inputPlaceholder = "{{input}}"
+	replyPlaceholder = "{{reply}}"
+
+	// maxTemplateLength is the max length (in characters) of a prompt template.
+	maxTemplateLength = 4000
+)
+
+var templateNamePattern = regexp.MustCompile(`^[\w-]{1,32}$`)
+
+const promptHelpInfo = "prompt \\[\\-u\\] save \\<name\\> \\<template\\>\n" +
+	"prompt \\[\\-u\\] list\n" +
+	"prompt \\[\\-u\\] rm \\<name\\>\n" +
+	"template is for current chat by default, and only admin can save or remove it in group, " +
+	"use `\\-u` for your own template, which has higher priority\\.\n" +
+	"`{{input}}` in template is replaced by your input, and `{{reply}}` is replaced by text of the replied message, " +
+	"input is appended to the end if there is no `{{input}}`\\.\n" +
+	"use `/p <name> <input>` to chat with template\\."
+
+// renderTemplate fills placeholders of template, input is appended if template has no `{{input}}`.
+func renderTemplate(template, input, reply string) string {
+	prompt := strings.ReplaceAll(template, replyPlaceholder, reply)
+	if strings.Contains(prompt, inputPlaceholder) {
+		return strings.ReplaceAll(prompt, inputPlaceholder, input)
+	}
+	if input == "" {
+		return prompt
+	}
+	return prompt + "\n" + input
+}
+
+// findTemplate finds template by name, user's own template has higher priority than chat's.
+func findTemplate(chatID, userID int64, name string) (string, bool, error) {
+	templates, err := orm.GetUserPromptTemplates(userID)
+	if err != nil {
+		return "", false, err
+	}
+	if template, ok := templates[name]; ok {
+		return template, true, nil
+	}
+	templates, err = orm.GetChatPromptTemplates(chatID)
+	if err != nil {
+		return "", false, err
+	}
+	template, ok := templates[name]
+	return template, ok, nil
+}
+
+// PromptHandler handle /prompt command.
+func PromptHandler(ctx Context) error {
+	command := entities.FromMessage(ctx.Message())
+	args := command.MultiArgsFrom(0)
+	offset := 0
+	userScope := len(args) > 0 && args[0] == cfgUserScope
+	if userScope {
+		offset = 1
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return ctx.Reply(promptHelpInfo, ModeMarkdownV2)
+	}
+
+	if args[0] == "list" {
+		return listTemplates(ctx, userScope)
+	}
+	if len(args) < 2 {
+		return ctx.Reply(promptHelpInfo, ModeMarkdownV2)
+	}
+	if !userScope && ctx.Chat().Type != ChatPrivate && !util.IsChatAdmin(ctx.Chat(), ctx.Sender()) {
+		return ctx.Reply("只有管理员才能修改本群的模板哦，可以用 `-u` 修改你自己的模板", ModeMarkdownV2)
+	}
+
+	name := args[1]
+	switch args[0] {
+	case "save":
+		if !templateNamePattern.MatchString(name) {
+			return ctx.Reply("模板名只能包含字母、数字、下划线和减号，最长 32 个字符")
+		}
+		_, template, err := entities.CommandTakeArgs(ctx.Message(), offset+2)
+		if err != nil || strings.TrimSpace(template) == "" {
+			return ctx.Reply(promptHelpInfo, ModeMarkdownV2)
+		}
+		if len([]rune(template)) > maxTemplateLength {
+			return ctx.Reply("模板太长了")
+		}
+		if userScope {
+			err = orm.SetUserPromptTemplate(ctx.Sender().ID, name, template)
+		} else {
+			err = orm.SetChatPromptTemplate(ctx.Chat().ID, name, template)
+		}
+		if err != nil {
+			return ctx.Reply("完了，删库跑路了")
+		}
+		return ctx.Reply(fmt.Sprintf("模板 %s 保存成功", name))
+	case "rm":
+		var ok bool
+		var err error
+		if userScope {
+			ok, err = orm.DelUserPromptTemplate(ctx.Sender().ID, name)
+		} else {
+			ok, err = orm.DelChatPromptTemplate(ctx.Chat().ID, name)
+		}
+		if err != nil {
+			return ctx.Reply("完了，删库跑路了")
+		}
+		if !ok {
+			return ctx.Reply(fmt.Sprintf("没有模板 %s", name))
+		}
+		return ctx.Reply(fmt.Sprintf("模板 %s 已删除", name))
+	}
+	return ctx.Reply(promptHelpInfo, ModeMarkdownV2)
+}
+
+func listTemplates(ctx Context, userScope bool) error {
+	var templates map[string]string
+	var err error
+	if userScope {
+		templates, err = orm.GetUserPromptTemplates(ctx.Sender().ID)
+	} else {
+		templates, err = orm.GetChatPromptTemplates(ctx.Chat().ID)
+	}
+	if err != nil {
+		return ctx.Reply("完了，删库跑路了")
+	}
+	if len(templates) == 0 {
+		return ctx.Reply("还没有模板哦")
+	}
+
+	names := make([]string, 0, len(templates))
+	for name := range templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	for _, name := range names {
+		template := templates[name]
+		if runes := []rune(template); len(runes) > 50 {
+			template = string(runes[:50]) + "..."
+		}
+		sb.WriteString(fmt.Sprintf("%s: %s\n", name, strings.ReplaceAll(template, "\n", " ")))
+	}
+	return ctx.Reply(sb.String())
+}
+
+// PromptChat is handler for chat with prompt template, `/p <name> <input>`.
+func PromptChat(ctx Context) error {
+	cmd, input, err := entities.CommandTakeArgs(ctx.Message(), 1)
+	if err != nil || cmd.Argc() == 0 {
+		return ctx.Reply(promptHelpInfo, ModeMarkdownV2)
+	}
+
+	name := cmd.Arg(0)
+	template, ok, err := findTemplate(ctx.Chat().ID, ctx.Sender().ID, name)
+	if err != nil {
+		log.Error("[ChatGPT] Can't find prompt template", zap.String("name", name), zap.Error(err))
+		return ctx.Reply("完了，删库跑路了")
+	}
+	if !ok {
+		return ctx.Reply(fmt.Sprintf("没有模板 %s，用 /prompt list 看看有哪些模板吧", name))
+	}
+
+	var reply string
+	if replyTo := ctx.Message().ReplyTo; replyTo != nil {
+		reply = replyTo.Text
+		if reply == "" {
+			reply = replyTo.Caption
+		}
+	}
+
+	input = strings.TrimSpace(input)
+	// only the user input is limited, template may be long.
+	limited := input + reply
+	opts := &chatOptions{limited: &limited}
+	return startChat(ctx, getProvider(cmd.Name()), renderTemplate(template, input, reply), opts)
+}
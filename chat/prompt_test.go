@@ -0,0 +1,27 @@
+package chat
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_renderTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		input    string
+		reply    string
+		want     string
+	}{
+		{"translate formally: {{input}}", "hello", "", "translate formally: hello"},
+		{"translate formally:", "hello", "", "translate formally:\nhello"},
+		{"translate formally:", "", "", "translate formally:"},
+		{"summarize:\n{{reply}}", "", "long text", "summarize:\nlong text"},
+		{"{{input}} of {{reply}}, {{input}}", "a", "b", "a of b, a"},
+		{"reply: {{reply}}", "input", "text", "reply: text\ninput"},
+	}
+	for _, tt := range tests {
+		got := renderTemplate(tt.template, tt.input, tt.reply)
+		require.Equalf(t, tt.want, got, "renderTemplate(%q, %q, %q)", tt.template, tt.input, tt.reply)
+	}
+}
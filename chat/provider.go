@@ -0,0 +1,82 @@
+package chat
+
+import (
+	"context"
+	"csust-got/config"
+	"csust-got/log"
+	"fmt"
+
+	openai "github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+)
+
+// provider types
+const (
+	ProviderOpenAI           = "openai"
+	ProviderOpenAICompatible = "openai_compatible"
+	ProviderCustom           = "custom"
+)
+
+// Provider is a backend of large language model.
+type Provider interface {
+	// Name is the name of provider in config.
+	Name() string
+	// Model is the default model of provider, empty means use global config.
+	Model() string
+	CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error)
+	CreateChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (Stream, error)
+}
+
+// Transcriber is a provider which can convert speech to text.
+type Transcriber interface {
+	CreateTranscription(ctx context.Context, req openai.AudioRequest) (openai.AudioResponse, error)
+}
+
+// Embedder is a provider which can create embeddings of text.
+type Embedder interface {
+	CreateEmbeddings(ctx context.Context, req openai.EmbeddingRequestConverter) (openai.EmbeddingResponse, error)
+}
+
+// Stream is a stream of chat completion.
+type Stream interface {
+	Recv() (openai.ChatCompletionStreamResponse, error)
+	Close() error
+}
+
+var providers = make(map[string]Provider)
+
+func initProviders() {
+	for _, cfg := range config.BotConfig.ChatConfig.Providers {
+		p, err := newProvider(cfg)
+		if err != nil {
+			log.Error("[ChatGPT] Can't init provider", zap.String("provider", cfg.Name), zap.Error(err))
+			continue
+		}
+		providers[cfg.Name] = p
+	}
+}
+
+func newProvider(cfg config.ProviderConfig) (Provider, error) {
+	switch cfg.Type {
+	case ProviderOpenAI, "":
+		return newOpenAIProvider(cfg), nil
+	case ProviderOpenAICompatible:
+		if cfg.BaseURL == "" {
+			return nil, fmt.Errorf("%w: base_url of %s provider is not set", ErrProviderConfigInvalid, cfg.Type)
+		}
+		return newOpenAIProvider(cfg), nil
+	case ProviderCustom:
+		return newCustomProvider(cfg), nil
+	default:
+		return nil, fmt.Errorf("%w: unknown provider type %s", ErrProviderConfigInvalid, cfg.Type)
+	}
+}
+
+// getProvider returns the provider which command `cmd` should use.
+func getProvider(cmd string) Provider {
+	chatCfg := config.BotConfig.ChatConfig
+	if name, ok := chatCfg.Commands[cmd]; ok {
+		return providers[name]
+	}
+	return providers[chatCfg.Provider]
+}
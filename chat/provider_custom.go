@@ -0,0 +1,126 @@
+package chat
+
+import (
+	"context"
+	"csust-got/config"
+	"csust-got/log"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	openai "github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+)
+
+type chatCustModel struct {
+	Text string `json:"text"`
+}
+
+// customProvider is the provider of our custom chat api, it only takes the last message of user.
+// `GET <base_url>?text=<prompt>` -> `{"text": "<answer>"}`
+type customProvider struct {
+	name    string
+	model   string
+	baseURL string
+}
+
+func newCustomProvider(cfg config.ProviderConfig) *customProvider {
+	return &customProvider{
+		name:    cfg.Name,
+		model:   cfg.Model,
+		baseURL: cfg.BaseURL,
+	}
+}
+
+func (p *customProvider) Name() string {
+	return p.name
+}
+
+func (p *customProvider) Model() string {
+	return p.model
+}
+
+func (p *customProvider) CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	var prompt string
+	for i := len(req.Messages) - 1; i >= 0; i-- {
+		if req.Messages[i].Role == openai.ChatMessageRoleUser {
+			prompt = messageText(&req.Messages[i])
+			break
+		}
+	}
+
+	serverAddress := p.baseURL + "?text=" + url.QueryEscape(prompt)
+	log.Debug("[ChatGPT] request custom chat api", zap.String("url", serverAddress))
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, serverAddress, nil)
+	if err != nil {
+		return openai.ChatCompletionResponse{}, err
+	}
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		log.Error("连接chat api服务器失败", zap.Error(err))
+		return openai.ChatCompletionResponse{}, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return openai.ChatCompletionResponse{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		log.Error("chat api服务器返回异常", zap.Int("status", resp.StatusCode), zap.String("body", string(body)))
+		return openai.ChatCompletionResponse{}, fmt.Errorf("request custom chat api failed, status code: %d", resp.StatusCode)
+	}
+
+	data := chatCustModel{}
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		log.Error("chat api服务器json反序列化失败", zap.Error(err), zap.String("body", string(body)))
+		return openai.ChatCompletionResponse{}, err
+	}
+
+	return openai.ChatCompletionResponse{
+		Model: req.Model,
+		Choices: []openai.ChatCompletionChoice{{
+			Message: openai.ChatCompletionMessage{
+				Role:    openai.ChatMessageRoleAssistant,
+				Content: data.Text,
+			},
+			FinishReason: "stop",
+		}},
+	}, nil
+}
+
+func (p *customProvider) CreateChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (Stream, error) {
+	resp, err := p.CreateChatCompletion(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return &onceStream{content: resp.Choices[0].Message.Content}, nil
+}
+
+// onceStream is a fake stream for api without stream support, it returns all content at once.
+type onceStream struct {
+	content string
+	done    bool
+}
+
+func (s *onceStream) Recv() (openai.ChatCompletionStreamResponse, error) {
+	if s.done {
+		return openai.ChatCompletionStreamResponse{}, io.EOF
+	}
+	s.done = true
+	return openai.ChatCompletionStreamResponse{
+		Choices: []openai.ChatCompletionStreamChoice{{
+			Delta: openai.ChatCompletionStreamChoiceDelta{
+				Content: s.content,
+			},
+		}},
+	}, nil
+}
+
+func (s *onceStream) Close() error {
+	return nil
+}
@@ -0,0 +1,55 @@
+package chat
+
+import (
+	"context"
+	"csust-got/config"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// openaiProvider is provider of openai, or any server compatible with openai api.
+type openaiProvider struct {
+	name   string
+	model  string
+	client *openai.Client
+}
+
+func newOpenAIProvider(cfg config.ProviderConfig) *openaiProvider {
+	clientCfg := openai.DefaultConfig(cfg.Key)
+	if cfg.BaseURL != "" {
+		clientCfg.BaseURL = cfg.BaseURL
+	}
+	return &openaiProvider{
+		name:   cfg.Name,
+		model:  cfg.Model,
+		client: openai.NewClientWithConfig(clientCfg),
+	}
+}
+
+func (p *openaiProvider) Name() string {
+	return p.name
+}
+
+func (p *openaiProvider) Model() string {
+	return p.model
+}
+
+func (p *openaiProvider) CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	return p.client.CreateChatCompletion(ctx, req)
+}
+
+func (p *openaiProvider) CreateChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (Stream, error) {
+	stream, err := p.client.CreateChatCompletionStream(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (p *openaiProvider) CreateTranscription(ctx context.Context, req openai.AudioRequest) (openai.AudioResponse, error) {
+	return p.client.CreateTranscription(ctx, req)
+}
+
+func (p *openaiProvider) CreateEmbeddings(ctx context.Context, req openai.EmbeddingRequestConverter) (openai.EmbeddingResponse, error) {
+	return p.client.CreateEmbeddings(ctx, req)
+}
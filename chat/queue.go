@@ -0,0 +1,208 @@
+package chat
+
+import (
+	"context"
+	"csust-got/config"
+	"csust-got/log"
+	"csust-got/util"
+	"errors"
+	"fmt"
+	"sync"
+
+	"go.uber.org/zap"
+	. "gopkg.in/telebot.v3"
+)
+
+type taskState int
+
+const (
+	taskQueued taskState = iota
+	taskRunning
+	taskCanceled
+)
+
+// chatQueue is the queue of chat requests, requests are handled by a fixed number of workers.
+type chatQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []*chatContext
+	running []*chatContext
+	users   map[int64]int // queued and running requests of every user
+}
+
+var queue = newChatQueue()
+
+func newChatQueue() *chatQueue {
+	q := &chatQueue{users: make(map[int64]int)}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// push adds request to the end of queue, returns how many requests are ahead of it.
+func (q *chatQueue) push(ctx *chatContext) (int, error) {
+	chatCfg := config.BotConfig.ChatConfig
+	userID := ctx.Sender().ID
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) >= chatCfg.QueueSize {
+		return 0, errQueueFull
+	}
+	if q.users[userID] >= chatCfg.UserConcurrency {
+		return 0, errTooManyRequests
+	}
+	q.users[userID]++
+	q.pending = append(q.pending, ctx)
+	q.cond.Signal()
+	return len(q.pending) - 1, nil
+}
+
+// pop takes the first request of queue, and blocks until there is one.
+func (q *chatQueue) pop() *chatContext {
+	q.mu.Lock()
+	for len(q.pending) == 0 {
+		q.cond.Wait()
+	}
+	ctx := q.pending[0]
+	q.pending = q.pending[1:]
+	q.running = append(q.running, ctx)
+	waiting := append([]*chatContext(nil), q.pending...)
+	q.mu.Unlock()
+
+	go func() {
+		for i, c := range waiting {
+			c.showPosition(i)
+		}
+	}()
+	return ctx
+}
+
+// done removes the finished request.
+func (q *chatQueue) done(ctx *chatContext) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, c := range q.running {
+		if c == ctx {
+			q.running = append(q.running[:i], q.running[i+1:]...)
+			break
+		}
+	}
+	q.release(ctx.Sender().ID)
+}
+
+func (q *chatQueue) release(userID int64) {
+	q.users[userID]--
+	if q.users[userID] <= 0 {
+		delete(q.users, userID)
+	}
+}
+
+// cancel cancels all queued and running requests matched by `match`, returns how many requests are canceled.
+func (q *chatQueue) cancel(match func(*chatContext) bool) int {
+	q.mu.Lock()
+	var canceled []*chatContext
+	pending := q.pending[:0]
+	for _, c := range q.pending {
+		if match(c) {
+			canceled = append(canceled, c)
+			q.release(c.Sender().ID)
+		} else {
+			pending = append(pending, c)
+		}
+	}
+	q.pending = pending
+	for _, c := range q.running {
+		if match(c) {
+			canceled = append(canceled, c)
+		}
+	}
+	q.mu.Unlock()
+
+	for _, c := range canceled {
+		c.cancelTask()
+	}
+	return len(canceled)
+}
+
+// showPosition shows position of request in queue, if it's still queued.
+func (ctx *chatContext) showPosition(ahead int) {
+	ctx.stateMu.Lock()
+	defer ctx.stateMu.Unlock()
+	if ctx.state != taskQueued {
+		return
+	}
+	text := "正在排队..."
+	if ahead > 0 {
+		text = fmt.Sprintf("正在排队，前面还有 %d 个对话...", ahead)
+	}
+	_, err := util.EditMessageWithError(ctx.msg, text)
+	if err != nil {
+		log.Error("[ChatGPT] Can't edit message", zap.Error(err))
+	}
+}
+
+// startTask marks request as running, returns false if it has been canceled.
+func (ctx *chatContext) startTask() bool {
+	ctx.stateMu.Lock()
+	defer ctx.stateMu.Unlock()
+	if ctx.state != taskQueued {
+		return false
+	}
+	ctx.state = taskRunning
+	_, err := util.EditMessageWithError(ctx.msg, "正在思考...")
+	if err != nil {
+		log.Error("[ChatGPT] Can't edit message", zap.Error(err))
+	}
+	return true
+}
+
+// cancelTask cancels request, queued request is dropped, and running request is stopped by its context.
+func (ctx *chatContext) cancelTask() {
+	ctx.stateMu.Lock()
+	defer ctx.stateMu.Unlock()
+	ctx.cancel()
+	if ctx.state == taskQueued {
+		_, err := util.EditMessageWithError(ctx.msg, "已取消")
+		if err != nil {
+			log.Error("[ChatGPT] Can't edit message", zap.Error(err))
+		}
+	}
+	ctx.state = taskCanceled
+}
+
+// canceled reports whether request is canceled by user.
+func (ctx *chatContext) canceled() bool {
+	return errors.Is(ctx.reqCtx.Err(), context.Canceled)
+}
+
+func chatWorker() {
+	for {
+		ctx := queue.pop()
+		handleChat(ctx)
+		queue.done(ctx)
+	}
+}
+
+// CancelHandler handle /chatcancel command.
+// Reply to a request or its reply to cancel it, otherwise all requests of sender in current chat are canceled.
+func CancelHandler(ctx Context) error {
+	chatID, sender := ctx.Chat().ID, ctx.Sender()
+	var match func(*chatContext) bool
+	if replyTo := ctx.Message().ReplyTo; replyTo != nil {
+		isAdmin := ctx.Chat().Type != ChatPrivate && util.IsChatAdmin(ctx.Chat(), sender)
+		match = func(c *chatContext) bool {
+			return c.Chat().ID == chatID && (c.msg.ID == replyTo.ID || c.Message().ID == replyTo.ID) &&
+				(c.Sender().ID == sender.ID || isAdmin)
+		}
+	} else {
+		match = func(c *chatContext) bool {
+			return c.Chat().ID == chatID && c.Sender().ID == sender.ID
+		}
+	}
+
+	n := queue.cancel(match)
+	if n == 0 {
+		return ctx.Reply("没有可以取消的对话")
+	}
+	return ctx.Reply(fmt.Sprintf("已取消 %d 个对话", n))
+}
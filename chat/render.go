@@ -0,0 +1,243 @@
+package chat
+
+import (
+	"html"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+const (
+	// maxMessageLength is the max length of telegram message, in UTF-16 code units.
+	maxMessageLength = 4096
+	// messageChunkLength is the length of every split message,
+	// some space is reserved for closing code block and debug info.
+	messageChunkLength = maxMessageLength - 256
+)
+
+var (
+	headingPattern = regexp.MustCompile(`^#{1,6}\s+(.*)$`)
+	bulletPattern  = regexp.MustCompile(`^(\s*)[*+-]\s+`)
+	linkPattern    = regexp.MustCompile(`^\[([^\]]+)\]\(([^)\s]+)\)`)
+)
+
+var htmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// renderHTML converts markdown of model output to telegram HTML.
+// Unclosed code block is closed, and unmatched markers are kept as they are, so partial output in stream is valid too.
+func renderHTML(md string) string {
+	var sb strings.Builder
+	var code []string
+	inCode, lang := false, ""
+	flushCode := func() {
+		if lang == "" {
+			sb.WriteString("<pre>")
+		} else {
+			sb.WriteString(`<pre><code class="language-` + html.EscapeString(lang) + `">`)
+		}
+		sb.WriteString(htmlEscaper.Replace(strings.Join(code, "\n")))
+		if lang == "" {
+			sb.WriteString("</pre>")
+		} else {
+			sb.WriteString("</code></pre>")
+		}
+		code = code[:0]
+	}
+
+	for i, line := range strings.Split(md, "\n") {
+		if fence, ok := codeFence(line); ok {
+			if inCode {
+				flushCode()
+				inCode = false
+			} else {
+				if i > 0 {
+					sb.WriteByte('\n')
+				}
+				inCode, lang = true, fence
+			}
+			continue
+		}
+		if inCode {
+			code = append(code, line)
+			continue
+		}
+
+		if i > 0 {
+			sb.WriteByte('\n')
+		}
+		if m := headingPattern.FindStringSubmatch(line); m != nil {
+			sb.WriteString("<b>" + renderInline(m[1]) + "</b>")
+			continue
+		}
+		if loc := bulletPattern.FindStringSubmatchIndex(line); loc != nil {
+			sb.WriteString(line[loc[2]:loc[3]] + "• ")
+			line = line[loc[1]:]
+		}
+		sb.WriteString(renderInline(line))
+	}
+	if inCode {
+		flushCode()
+	}
+	return sb.String()
+}
+
+// codeFence checks if line is a fence of code block, and returns the language.
+func codeFence(line string) (string, bool) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "```") {
+		return "", false
+	}
+	return strings.TrimSpace(strings.TrimLeft(line, "`")), true
+}
+
+var inlineTags = []struct {
+	marker string
+	tag    string
+}{
+	{"**", "b"},
+	{"__", "b"},
+	{"~~", "s"},
+	{"*", "i"},
+	{"_", "i"},
+}
+
+// renderInline converts inline markdown (code, bold, italic, strikethrough and link) to telegram HTML.
+func renderInline(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); {
+		rest := s[i:]
+
+		if rest[0] == '`' {
+			if end := strings.IndexByte(rest[1:], '`'); end > 0 {
+				sb.WriteString("<code>" + htmlEscaper.Replace(rest[1:end+1]) + "</code>")
+				i += end + 2
+				continue
+			}
+		}
+
+		if rest[0] == '[' {
+			if m := linkPattern.FindStringSubmatch(rest); m != nil {
+				sb.WriteString(`<a href="` + html.EscapeString(m[2]) + `">` + renderInline(m[1]) + "</a>")
+				i += len(m[0])
+				continue
+			}
+		}
+
+		if n, inner, tag, ok := matchEmphasis(s, i); ok {
+			sb.WriteString("<" + tag + ">" + renderInline(inner) + "</" + tag + ">")
+			i += n
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(rest)
+		sb.WriteString(htmlEscaper.Replace(string(r)))
+		i += size
+	}
+	return sb.String()
+}
+
+// matchEmphasis matches emphasis starts at s[i], returns length of the whole emphasis and the inner text.
+func matchEmphasis(s string, i int) (n int, inner string, tag string, ok bool) {
+	rest := s[i:]
+	for _, t := range inlineTags {
+		if !strings.HasPrefix(rest, t.marker) {
+			continue
+		}
+		body := rest[len(t.marker):]
+		// `* item` or `a * b` is not emphasis
+		if body == "" || body[0] == ' ' || strings.HasPrefix(body, t.marker[:1]) {
+			continue
+		}
+		end := strings.Index(body, t.marker)
+		if end <= 0 || body[end-1] == ' ' {
+			continue
+		}
+		// `snake_case_name` is not emphasis
+		if t.marker[0] == '_' && (isWordBefore(s, i) || isWordAfter(body, end+len(t.marker))) {
+			continue
+		}
+		return len(t.marker)*2 + end, body[:end], t.tag, true
+	}
+	return 0, "", "", false
+}
+
+func isWordBefore(s string, i int) bool {
+	r, _ := utf8.DecodeLastRuneInString(s[:i])
+	return i > 0 && (unicode.IsLetter(r) || unicode.IsDigit(r))
+}
+
+func isWordAfter(s string, i int) bool {
+	r, _ := utf8.DecodeRuneInString(s[i:])
+	return i < len(s) && (unicode.IsLetter(r) || unicode.IsDigit(r))
+}
+
+// utf16Len returns length of text in UTF-16 code units, which is how telegram counts message length.
+func utf16Len(text string) int {
+	n := 0
+	for _, r := range text {
+		n += utf16.RuneLen(r)
+	}
+	return n
+}
+
+// splitMessage splits long text into chunks not longer than limit, paragraph and line boundaries are preferred.
+// Code block across chunks is closed at the end of chunk and reopened in the next chunk.
+// Blank chunks are dropped, so there is no chunk if text is blank.
+func splitMessage(text string, limit int) []string {
+	var chunks []string
+	for utf16Len(text) > limit {
+		cut, next := cutPoint(text, limit)
+		if chunk := strings.TrimRight(text[:cut], "\n"); strings.TrimSpace(chunk) != "" {
+			chunks = append(chunks, chunk)
+		}
+		text = strings.TrimLeft(text[next:], "\n")
+	}
+	if strings.TrimSpace(text) != "" {
+		chunks = append(chunks, text)
+	}
+
+	inCode, lang := false, ""
+	for i := range chunks {
+		if inCode {
+			chunks[i] = "```" + lang + "\n" + chunks[i]
+		}
+		inCode = false
+		for _, line := range strings.Split(chunks[i], "\n") {
+			if fence, ok := codeFence(line); ok {
+				if !inCode {
+					lang = fence
+				}
+				inCode = !inCode
+			}
+		}
+		if inCode && i < len(chunks)-1 {
+			chunks[i] += "\n```"
+		}
+	}
+	return chunks
+}
+
+// cutPoint finds where to split text, text[:cut] is not longer than limit, and the rest starts from text[next:].
+func cutPoint(text string, limit int) (cut, next int) {
+	maxCut, n := 0, 0
+	for i, r := range text {
+		n += utf16.RuneLen(r)
+		if n > limit {
+			break
+		}
+		maxCut = i + utf8.RuneLen(r)
+	}
+	if maxCut == 0 {
+		_, maxCut = utf8.DecodeRuneInString(text)
+	}
+
+	prefix := text[:maxCut]
+	for _, sep := range []string{"\n\n", "\n", " "} {
+		if cut = strings.LastIndex(prefix, sep); cut > maxCut/2 {
+			return cut, cut + len(sep)
+		}
+	}
+	return maxCut, maxCut
+}
@@ -0,0 +1,64 @@
+package chat
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_renderHTML(t *testing.T) {
+	tests := []struct {
+		md   string
+		want string
+	}{
+		{"hello", "hello"},
+		{"a < b && c > d", "a &lt; b &amp;&amp; c &gt; d"},
+		{"**bold** and *italic*", "<b>bold</b> and <i>italic</i>"},
+		{"__bold__ _italic_ ~~del~~", "<b>bold</b> <i>italic</i> <s>del</s>"},
+		{"snake_case_name", "snake_case_name"},
+		{"a * b * c", "a * b * c"},
+		{"**unclosed", "**unclosed"},
+		{"use `a<b>` here", "use <code>a&lt;b&gt;</code> here"},
+		{"[link](https://example.com/?a=1&b=2)", `<a href="https://example.com/?a=1&amp;b=2">link</a>`},
+		{"# Title\ntext", "<b>Title</b>\ntext"},
+		{"- one\n* two", "• one\n• two"},
+		{"```go\nif a < b {}\n```", `<pre><code class="language-go">if a &lt; b {}</code></pre>`},
+		{"text\n```\n**not bold**\n```\nend", "text\n<pre>**not bold**</pre>\nend"},
+		{"```py\nprint(1)", `<pre><code class="language-py">print(1)</code></pre>`},
+	}
+	for _, tt := range tests {
+		got := renderHTML(tt.md)
+		require.Equalf(t, tt.want, got, "renderHTML(%q)", tt.md)
+	}
+}
+
+func Test_splitMessage(t *testing.T) {
+	require.Equal(t, []string{"short"}, splitMessage("short", 10))
+	require.Empty(t, splitMessage(" \n ", 10))
+	// blank chunks are dropped, so that chunks match messages
+	require.Equal(t, []string{"aaaa", "bbbb"}, splitMessage("aaaa\n\n      \n\nbbbb", 6))
+
+	// split at paragraph boundary
+	require.Equal(t, []string{"aaaa bbbb", "cccc"}, splitMessage("aaaa bbbb\n\ncccc", 12))
+
+	// split at space if there is no newline
+	require.Equal(t, []string{"aaaa bbbb", "cccc dddd"}, splitMessage("aaaa bbbb cccc dddd", 12))
+
+	// hard split if there is no boundary
+	require.Equal(t, []string{"aaaaa", "aaaaa", "aa"}, splitMessage("aaaaaaaaaaaa", 5))
+
+	// emoji is counted as 2 UTF-16 code units
+	for _, chunk := range splitMessage(strings.Repeat("😀", 10), 5) {
+		require.LessOrEqual(t, utf16Len(chunk), 5)
+	}
+
+	// code block is closed and reopened across chunks
+	text := "```go\n" + strings.Repeat("line\n", 10) + "```"
+	chunks := splitMessage(text, 30)
+	require.Greater(t, len(chunks), 1)
+	for i, chunk := range chunks {
+		require.Truef(t, strings.HasPrefix(chunk, "```go\n"), "chunk %d: %q", i, chunk)
+		require.Truef(t, strings.HasSuffix(chunk, "```"), "chunk %d: %q", i, chunk)
+	}
+}
@@ -0,0 +1,67 @@
+package chat
+
+import (
+	"csust-got/log"
+	"csust-got/util"
+
+	"go.uber.org/zap"
+	. "gopkg.in/telebot.v3"
+)
+
+// replyMessages is the messages showing a reply, long reply is split into several messages,
+// and every message replies to the previous one.
+type replyMessages struct {
+	msgs   []*Message
+	chunks []string
+}
+
+func newReplyMessages(msg *Message) *replyMessages {
+	return &replyMessages{
+		msgs:   []*Message{msg},
+		chunks: []string{""},
+	}
+}
+
+// update shows content in reply messages, only changed chunks are edited, and new messages are sent if needed.
+func (r *replyMessages) update(content string) error {
+	for i, chunk := range splitMessage(content, messageChunkLength) {
+		if i < len(r.chunks) && r.chunks[i] == chunk {
+			continue
+		}
+		if i < len(r.msgs) {
+			msg, err := editRendered(r.msgs[i], chunk)
+			if err != nil {
+				return err
+			}
+			r.msgs[i], r.chunks[i] = msg, chunk
+			continue
+		}
+		msg, err := sendRendered(r.msgs[len(r.msgs)-1], chunk)
+		if err != nil {
+			return err
+		}
+		r.msgs = append(r.msgs, msg)
+		r.chunks = append(r.chunks, chunk)
+	}
+	return nil
+}
+
+// editRendered edits message with rendered text, and falls back to plain text if telegram can't parse it.
+func editRendered(msg *Message, text string) (*Message, error) {
+	newMsg, err := util.EditMessageWithError(msg, renderHTML(text), ModeHTML)
+	if err == nil {
+		return newMsg, nil
+	}
+	log.Debug("[ChatGPT] Can't edit message in HTML, fallback to plain text", zap.Error(err))
+	return util.EditMessageWithError(msg, text)
+}
+
+// sendRendered sends rendered text as reply of msg, and falls back to plain text if telegram can't parse it.
+func sendRendered(msg *Message, text string) (*Message, error) {
+	newMsg, err := util.SendReplyWithError(msg.Chat, renderHTML(text), msg, ModeHTML)
+	if err == nil {
+		return newMsg, nil
+	}
+	log.Debug("[ChatGPT] Can't send message in HTML, fallback to plain text", zap.Error(err))
+	return util.SendReplyWithError(msg.Chat, text, msg)
+}
@@ -0,0 +1,305 @@
+package chat
+
+import (
+	"bytes"
+	"csust-got/config"
+	"csust-got/entities"
+	"csust-got/log"
+	"csust-got/orm"
+	"csust-got/util"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	openai "github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	. "gopkg.in/telebot.v3"
+)
+
+// maxSessionMessages is the max messages kept in a session, the oldest messages are dropped.
+const maxSessionMessages = 200
+
+// session is a named conversation of user, it's independent of reply chain and shared by all chats of user,
+// but it's only active in the chat where it's created or switched to.
+type session struct {
+	Name      string                         `json:"name"`
+	CreatedAt int64                          `json:"created_at"`
+	UpdatedAt int64                          `json:"updated_at"`
+	Messages  []openai.ChatCompletionMessage `json:"messages"`
+}
+
+func sessionRetention() time.Duration {
+	return time.Duration(config.BotConfig.ChatConfig.SessionRetention) * 24 * time.Hour
+}
+
+func loadSession(userID int64, name string) (*session, error) {
+	data, err := orm.GetChatSession(userID, name)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalSession(name, data)
+}
+
+func unmarshalSession(name, data string) (*session, error) {
+	s := &session{}
+	if err := json.Unmarshal([]byte(data), s); err != nil {
+		log.Error("[ChatGPT] Can't unmarshal session", zap.String("name", name), zap.Error(err))
+		return nil, err
+	}
+	return s, nil
+}
+
+func marshalSession(s *session) (string, error) {
+	if len(s.Messages) > maxSessionMessages {
+		s.Messages = s.Messages[len(s.Messages)-maxSessionMessages:]
+	}
+	s.UpdatedAt = time.Now().Unix()
+	data, err := json.Marshal(s)
+	return string(data), err
+}
+
+func saveSession(userID int64, s *session) error {
+	data, err := marshalSession(s)
+	if err != nil {
+		return err
+	}
+	return orm.SetChatSession(userID, s.Name, data, sessionRetention())
+}
+
+// updateSession updates an existing session of user by update atomically, and refreshes it if it's active in chat.
+// redis.Nil is returned if session is expired.
+func updateSession(chatID, userID int64, name string, update func(s *session)) error {
+	return orm.UpdateChatSession(chatID, userID, name, func(data string) (string, error) {
+		s, err := unmarshalSession(name, data)
+		if err != nil {
+			return "", err
+		}
+		update(s)
+		return marshalSession(s)
+	}, sessionRetention())
+}
+
+// activeSession returns the active session of user in chat, nil if there is no active session.
+func activeSession(chatID, userID int64) *session {
+	name, err := orm.GetActiveChatSession(chatID, userID)
+	if err != nil {
+		return nil
+	}
+	s, err := loadSession(userID, name)
+	if errors.Is(err, redis.Nil) {
+		// session is expired
+		_ = orm.SetActiveChatSession(chatID, userID, "", 0)
+		return nil
+	}
+	if err != nil {
+		return nil
+	}
+	return s
+}
+
+// appendSession appends the new turn of request to session.
+func appendSession(ctx *chatContext) {
+	// the new turn starts from prompt, which is the last user message.
+	msgs := ctx.req.Messages
+	start := len(msgs)
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if msgs[i].Role == openai.ChatMessageRoleUser {
+			start = i
+			break
+		}
+	}
+	err := updateSession(ctx.Chat().ID, ctx.Sender().ID, ctx.opts.session, func(s *session) {
+		s.Messages = append(s.Messages, msgs[start:]...)
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		log.Error("[ChatGPT] Can't save session", zap.String("name", ctx.opts.session), zap.Error(err))
+	}
+}
+
+// sessionName returns name in args or the active session.
+func sessionName(chatID, userID int64, name string) (string, bool) {
+	if name != "" {
+		return name, true
+	}
+	name, err := orm.GetActiveChatSession(chatID, userID)
+	return name, err == nil
+}
+
+// ChatNewHandler handle /chatnew command.
+func ChatNewHandler(ctx Context) error {
+	chatID, userID := ctx.Chat().ID, ctx.Sender().ID
+	command := entities.FromMessage(ctx.Message())
+	name := command.Arg(0)
+	if name == "" {
+		name = time.Now().In(util.TimeZoneCST).Format("0102-150405")
+	}
+	if !templateNamePattern.MatchString(name) {
+		return ctx.Reply("会话名只能包含字母、数字、下划线和减号，最长 32 个字符")
+	}
+
+	_, err := loadSession(userID, name)
+	if err == nil {
+		return ctx.Reply(fmt.Sprintf("已经有会话 %s 了，可以用 /chatswitch %s 切换过去", name, name))
+	}
+	if !errors.Is(err, redis.Nil) {
+		return ctx.Reply("完了，删库跑路了")
+	}
+
+	now := time.Now().Unix()
+	if err = saveSession(userID, &session{Name: name, CreatedAt: now}); err != nil {
+		return ctx.Reply("完了，删库跑路了")
+	}
+	if err = orm.SetActiveChatSession(chatID, userID, name, sessionRetention()); err != nil {
+		return ctx.Reply("完了，删库跑路了")
+	}
+	return ctx.Reply(fmt.Sprintf("已创建并切换到会话 %s，之后的对话会在这个会话里继续，回复我的消息仍然会按回复链继续", name))
+}
+
+// ChatListHandler handle /chatlist command.
+func ChatListHandler(ctx Context) error {
+	chatID, userID := ctx.Chat().ID, ctx.Sender().ID
+	names, err := orm.GetChatSessionNames(userID)
+	if err != nil {
+		return ctx.Reply("完了，删库跑路了")
+	}
+
+	sessions := make([]*session, 0, len(names))
+	for _, name := range names {
+		s, err := loadSession(userID, name)
+		if errors.Is(err, redis.Nil) {
+			_ = orm.DelChatSession(userID, name)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		sessions = append(sessions, s)
+	}
+	if len(sessions) == 0 {
+		return ctx.Reply("还没有会话哦，用 /chatnew 创建一个吧")
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].UpdatedAt > sessions[j].UpdatedAt })
+
+	active, _ := orm.GetActiveChatSession(chatID, userID)
+	var sb strings.Builder
+	sb.WriteString("你的会话:\n")
+	for _, s := range sessions {
+		mark := "  "
+		if s.Name == active {
+			mark = "* "
+		}
+		sb.WriteString(fmt.Sprintf("%s%s (%d 条消息, %s)\n", mark, s.Name, len(s.Messages),
+			time.Unix(s.UpdatedAt, 0).In(util.TimeZoneCST).Format("2006-01-02 15:04")))
+	}
+	return ctx.Reply(sb.String())
+}
+
+// ChatSwitchHandler handle /chatswitch command, switch to no session if name is empty.
+func ChatSwitchHandler(ctx Context) error {
+	chatID, userID := ctx.Chat().ID, ctx.Sender().ID
+	command := entities.FromMessage(ctx.Message())
+	name := command.Arg(0)
+	if name == "" {
+		if err := orm.SetActiveChatSession(chatID, userID, "", 0); err != nil {
+			return ctx.Reply("完了，删库跑路了")
+		}
+		return ctx.Reply("已退出会话，只能通过回复我的消息继续对话了")
+	}
+
+	_, err := loadSession(userID, name)
+	if errors.Is(err, redis.Nil) {
+		return ctx.Reply(fmt.Sprintf("没有会话 %s，用 /chatlist 看看有哪些会话吧", name))
+	}
+	if err != nil {
+		return ctx.Reply("完了，删库跑路了")
+	}
+	if err = orm.SetActiveChatSession(chatID, userID, name, sessionRetention()); err != nil {
+		return ctx.Reply("完了，删库跑路了")
+	}
+	return ctx.Reply(fmt.Sprintf("已切换到会话 %s", name))
+}
+
+// ChatExportHandler handle /chatexport command, `/chatexport [name] [md|json]`.
+func ChatExportHandler(ctx Context) error {
+	chatID, userID := ctx.Chat().ID, ctx.Sender().ID
+	command := entities.FromMessage(ctx.Message())
+	format, name := "md", ""
+	for _, arg := range command.MultiArgsFrom(0) {
+		if arg == "md" || arg == "json" {
+			format = arg
+		} else {
+			name = arg
+		}
+	}
+
+	name, ok := sessionName(chatID, userID, name)
+	if !ok {
+		return ctx.Reply("当前没有会话，请指定要导出的会话")
+	}
+	s, err := loadSession(userID, name)
+	if errors.Is(err, redis.Nil) {
+		return ctx.Reply(fmt.Sprintf("没有会话 %s", name))
+	}
+	if err != nil {
+		return ctx.Reply("完了，删库跑路了")
+	}
+
+	var data []byte
+	var mime string
+	if format == "json" {
+		data, err = json.MarshalIndent(s, "", "  ")
+		if err != nil {
+			return ctx.Reply("感觉有点问题")
+		}
+		mime = "application/json"
+	} else {
+		data = []byte(sessionMarkdown(s))
+		mime = "text/markdown"
+	}
+	return ctx.Reply(&Document{
+		File:     FromReader(bytes.NewReader(data)),
+		FileName: s.Name + "." + format,
+		MIME:     mime,
+	})
+}
+
+// sessionMarkdown formats session as markdown.
+func sessionMarkdown(s *session) string {
+	var sb strings.Builder
+	sb.WriteString("# " + s.Name + "\n\n")
+	for i := range s.Messages {
+		msg := &s.Messages[i]
+		text := messageText(msg)
+		if text == "" {
+			continue
+		}
+		if isSummary(msg) {
+			sb.WriteString("> " + strings.ReplaceAll(text, "\n", "\n> ") + "\n\n")
+			continue
+		}
+		sb.WriteString("**" + msg.Role + "**:\n\n" + text + "\n\n")
+	}
+	return sb.String()
+}
+
+// ChatClearHandler handle /chatclear command, clear messages of session but keep it.
+func ChatClearHandler(ctx Context) error {
+	chatID, userID := ctx.Chat().ID, ctx.Sender().ID
+	command := entities.FromMessage(ctx.Message())
+	name, ok := sessionName(chatID, userID, command.Arg(0))
+	if !ok {
+		return ctx.Reply("当前没有会话，请指定要清空的会话")
+	}
+	err := updateSession(chatID, userID, name, func(s *session) { s.Messages = nil })
+	if errors.Is(err, redis.Nil) {
+		return ctx.Reply(fmt.Sprintf("没有会话 %s", name))
+	}
+	if err != nil {
+		return ctx.Reply("完了，删库跑路了")
+	}
+	return ctx.Reply(fmt.Sprintf("会话 %s 已清空", name))
+}
@@ -0,0 +1,25 @@
+package chat
+
+import (
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_sessionMarkdown(t *testing.T) {
+	s := &session{
+		Name: "test",
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleSystem, Content: summaryPrefix + "a\nb"},
+			{Role: openai.ChatMessageRoleUser, Content: "hi"},
+			{Role: openai.ChatMessageRoleAssistant, Content: ""},
+			{Role: openai.ChatMessageRoleAssistant, Content: "hello"},
+		},
+	}
+	want := "# test\n\n" +
+		"> " + "以下是之前对话的摘要：\n> a\n> b\n\n" +
+		"**user**:\n\nhi\n\n" +
+		"**assistant**:\n\nhello\n\n"
+	require.Equal(t, want, sessionMarkdown(s))
+}
@@ -0,0 +1,100 @@
+package chat
+
+import (
+	"csust-got/config"
+	"strings"
+	"unicode"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+const (
+	// tokensPerMessage is the extra tokens of every message, such as role and separator.
+	tokensPerMessage = 4
+	// tokensPerReply is the extra tokens of every reply, reply is primed with `<|start|>assistant<|message|>`.
+	tokensPerReply = 3
+)
+
+// countTokens estimates tokens of text like cl100k_base tokenizer.
+// A CJK character is about one token, and other text is about four characters one token.
+// It's only an estimate, which may be off for text mixed CJK and code, see `prompt_limit` in config.yaml.
+func countTokens(text string) int {
+	tokens := 0
+	others := 0
+	for _, r := range text {
+		switch {
+		case unicode.Is(unicode.Han, r), unicode.Is(unicode.Hiragana, r),
+			unicode.Is(unicode.Katakana, r), unicode.Is(unicode.Hangul, r):
+			tokens++
+		case unicode.IsSpace(r):
+			// space is merged into the next word
+			tokens += (others + 3) / 4
+			others = 0
+		case r > unicode.MaxASCII:
+			// other non-ascii characters are usually split into bytes
+			tokens++
+		default:
+			others++
+		}
+	}
+	tokens += (others + 3) / 4
+	return tokens
+}
+
+// countMessageTokens estimates tokens of a message.
+func countMessageTokens(msg *openai.ChatCompletionMessage) int {
+	tokens := tokensPerMessage + countTokens(msg.Role) + countTokens(msg.Content) + countTokens(msg.Name)
+	for _, part := range msg.MultiContent {
+		if part.Type == openai.ChatMessagePartTypeImageURL {
+			tokens += imageTokens
+		} else {
+			tokens += countTokens(part.Text)
+		}
+	}
+	return tokens
+}
+
+// countMessagesTokens estimates tokens of messages, include the priming tokens of reply.
+func countMessagesTokens(msgs []openai.ChatCompletionMessage) int {
+	tokens := tokensPerReply
+	for i := range msgs {
+		tokens += countMessageTokens(&msgs[i])
+	}
+	return tokens
+}
+
+// matchModel finds value of model in m, which is matched by the longest prefix of model name.
+func matchModel[T any](m map[string]T, model string) (value T, ok bool) {
+	matched := ""
+	for prefix, v := range m {
+		if strings.HasPrefix(model, prefix) && len(prefix) > len(matched) {
+			value, matched, ok = v, prefix, true
+		}
+	}
+	return value, ok
+}
+
+// contextWindow returns context window of model.
+func contextWindow(model string) int {
+	chatCfg := config.BotConfig.ChatConfig
+	if window, ok := matchModel(chatCfg.ContextWindows, model); ok {
+		return window
+	}
+	return chatCfg.ContextWindow
+}
+
+// trimHistory drops the oldest messages of history until it's tokens are not more than budget.
+// History always starts with a user message after trimmed, so turns are dropped as a whole.
+func trimHistory(history []openai.ChatCompletionMessage, budget int) (kept, dropped []openai.ChatCompletionMessage) {
+	tokens := 0
+	for i := range history {
+		tokens += countMessageTokens(&history[i])
+	}
+
+	start := 0
+	for start < len(history) && (tokens > budget || history[start].Role != openai.ChatMessageRoleUser) {
+		tokens -= countMessageTokens(&history[start])
+		start++
+	}
+	return history[start:], history[:start]
+}
@@ -0,0 +1,66 @@
+package chat
+
+import (
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_countTokens(t *testing.T) {
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"", 0},
+		{"hello", 2},
+		{"hello world", 4},
+		{"你好，世界", 5},
+		{"你好 world", 4},
+		{"   ", 0},
+	}
+	for _, tt := range tests {
+		got := countTokens(tt.text)
+		require.Equalf(t, tt.want, got, "countTokens(%s)", tt.text)
+	}
+
+	// chinese text should not cost 3x tokens of its length
+	require.Less(t, countTokens("这是一段中文"), len("这是一段中文"))
+}
+
+func Test_trimHistory(t *testing.T) {
+	user := func(s string) openai.ChatCompletionMessage {
+		return openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: s}
+	}
+	assistant := func(s string) openai.ChatCompletionMessage {
+		return openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: s}
+	}
+	history := []openai.ChatCompletionMessage{
+		user("一二三四五六七八九十"), assistant("一二三四五六七八九十"),
+		user("一二三四五六七八九十"), assistant("一二三四五六七八九十"),
+	}
+	turnTokens := countMessageTokens(&history[0]) + countMessageTokens(&history[1])
+
+	kept, dropped := trimHistory(history, 2*turnTokens)
+	require.Len(t, kept, 4)
+	require.Empty(t, dropped)
+
+	// drop a whole turn even if only user message should be dropped
+	kept, dropped = trimHistory(history, 2*turnTokens-1)
+	require.Equal(t, history[2:], kept)
+	require.Equal(t, history[:2], dropped)
+
+	kept, dropped = trimHistory(history, 0)
+	require.Empty(t, kept)
+	require.Len(t, dropped, 4)
+}
+
+func Test_countMessageTokensWithImage(t *testing.T) {
+	msg := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: "hello"}
+	textTokens := countMessageTokens(&msg)
+
+	req := &openai.ChatCompletionRequest{Messages: []openai.ChatCompletionMessage{msg}}
+	attachImage(req, "data:image/jpeg;base64,AAAA")
+	require.Equal(t, textTokens+imageTokens, countMessageTokens(&req.Messages[0]))
+	require.Equal(t, "hello\n"+imagePlaceholder, messageText(&req.Messages[0]))
+}
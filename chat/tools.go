@@ -0,0 +1,211 @@
+package chat
+
+import (
+	"csust-got/base"
+	"csust-got/config"
+	"csust-got/log"
+	"csust-got/prom"
+	"csust-got/util"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/sashabaranov/go-openai/jsonschema"
+	"go.uber.org/zap"
+	. "gopkg.in/telebot.v3"
+)
+
+// maxToolRounds is the max rounds of tool calls in one chat, model must answer after that.
+const maxToolRounds = 5
+
+// tool is a function that model can call.
+type tool struct {
+	definition openai.FunctionDefinition
+	call       func(ctx *chatContext, args string) (string, error)
+}
+
+var tools = map[string]*tool{
+	"create_reminder": {
+		definition: openai.FunctionDefinition{
+			Name:        "create_reminder",
+			Description: "Remind the user with a message after a while, the user will be mentioned in current chat.",
+			Parameters: jsonschema.Definition{
+				Type: jsonschema.Object,
+				Properties: map[string]jsonschema.Definition{
+					"delay": {
+						Type:        jsonschema.String,
+						Description: "How long to wait, in Go duration format, e.g. `30m`, `2h`, `1h30m`.",
+					},
+					"content": {
+						Type:        jsonschema.String,
+						Description: "What to remind the user.",
+					},
+				},
+				Required: []string{"delay", "content"},
+			},
+		},
+		call: createReminder,
+	},
+	"get_hitokoto": {
+		definition: openai.FunctionDefinition{
+			Name:        "get_hitokoto",
+			Description: "Get a random famous sentence (hitokoto) with its author and source.",
+			Parameters: jsonschema.Definition{
+				Type: jsonschema.Object,
+				Properties: map[string]jsonschema.Definition{
+					"type": {
+						Type: jsonschema.String,
+						Description: "Optional types of sentence, can be combined, e.g. `ai`. " +
+							"a: anime, b: comic, c: game, d: literature, e: original, f: internet, g: other, " +
+							"h: film, i: poetry, j: netease music, k: philosophy, l: joke.",
+					},
+				},
+			},
+		},
+		call: getHitokoto,
+	},
+	"search_link": {
+		definition: openai.FunctionDefinition{
+			Name:        "search_link",
+			Description: "Build a link of search result page, the link can be sent to user.",
+			Parameters: jsonschema.Definition{
+				Type: jsonschema.Object,
+				Properties: map[string]jsonschema.Definition{
+					"engine": {
+						Type: jsonschema.String,
+						Enum: []string{"google", "bing", "bilibili", "github"},
+					},
+					"keyword": {
+						Type: jsonschema.String,
+					},
+				},
+				Required: []string{"engine", "keyword"},
+			},
+		},
+		call: searchLink,
+	},
+	"message_rank": {
+		definition: openai.FunctionDefinition{
+			Name:        "message_rank",
+			Description: "Query the users who sent the most messages or stickers in current group in 24 hours.",
+			Parameters: jsonschema.Definition{
+				Type: jsonschema.Object,
+				Properties: map[string]jsonschema.Definition{
+					"type": {
+						Type: jsonschema.String,
+						Enum: []string{"message", "sticker"},
+					},
+				},
+			},
+		},
+		call: messageRank,
+	},
+}
+
+// enabledTools returns tools enabled in config.
+func enabledTools() []openai.Tool {
+	res := make([]openai.Tool, 0, len(tools))
+	for _, name := range config.BotConfig.ChatConfig.Tools {
+		t, ok := tools[name]
+		if !ok {
+			log.Warn("[ChatGPT] tool not exists", zap.String("tool", name))
+			continue
+		}
+		def := t.definition
+		res = append(res, openai.Tool{Type: openai.ToolTypeFunction, Function: &def})
+	}
+	return res
+}
+
+// callTool calls tool and returns the result for model, error will be returned to model too.
+func callTool(ctx *chatContext, call *openai.ToolCall) string {
+	log.Debug("[ChatGPT] call tool", zap.String("tool", call.Function.Name), zap.String("args", call.Function.Arguments))
+	t, ok := tools[call.Function.Name]
+	if !ok {
+		return "error: tool not exists"
+	}
+	res, err := t.call(ctx, call.Function.Arguments)
+	if err != nil {
+		log.Error("[ChatGPT] call tool failed", zap.String("tool", call.Function.Name), zap.Error(err))
+		return "error: " + err.Error()
+	}
+	return res
+}
+
+func createReminder(ctx *chatContext, args string) (string, error) {
+	var params struct {
+		Delay   string `json:"delay"`
+		Content string `json:"content"`
+	}
+	if err := json.Unmarshal([]byte(args), &params); err != nil {
+		return "", err
+	}
+	delay, err := util.EvalDuration(params.Delay)
+	if err != nil {
+		return "", err
+	}
+	if delay < time.Second {
+		return "", fmt.Errorf("delay is too short: %v", delay)
+	}
+	base.AddTimerTask(ctx.Sender(), ctx.Chat().ID, strings.TrimSpace(params.Content), delay)
+	return fmt.Sprintf("reminder created, will remind at %s", time.Now().Add(delay).In(util.TimeZoneCST).Format(time.RFC3339)), nil
+}
+
+func getHitokoto(_ *chatContext, args string) (string, error) {
+	var params struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal([]byte(args), &params); err != nil {
+		return "", err
+	}
+	return base.GetHitokoto(base.HitokotoArg(params.Type), true), nil
+}
+
+func searchLink(_ *chatContext, args string) (string, error) {
+	var params struct {
+		Engine  string `json:"engine"`
+		Keyword string `json:"keyword"`
+	}
+	if err := json.Unmarshal([]byte(args), &params); err != nil {
+		return "", err
+	}
+	link, ok := base.SearchURL(params.Engine, params.Keyword)
+	if !ok {
+		return "", fmt.Errorf("search engine %s not supported", params.Engine)
+	}
+	return link, nil
+}
+
+func messageRank(ctx *chatContext, args string) (string, error) {
+	var params struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal([]byte(args), &params); err != nil {
+		return "", err
+	}
+	if !config.BotConfig.PromConfig.Enabled {
+		return "", errors.New("message statistics is not enabled")
+	}
+	if ctx.Chat().Type == ChatPrivate {
+		return "", errors.New("message statistics is only available in group")
+	}
+
+	var data []prom.MsgCount
+	var err error
+	if params.Type == "sticker" {
+		data, err = prom.QueryStickerCount(ctx.Chat().Title)
+	} else {
+		data, err = prom.QueryMessageCount(ctx.Chat().Title)
+	}
+	if err != nil {
+		return "", err
+	}
+	bs, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	return string(bs), nil
+}
@@ -0,0 +1,179 @@
+package chat
+
+import (
+	"context"
+	"csust-got/config"
+	"csust-got/entities"
+	"csust-got/log"
+	"csust-got/orm"
+	"csust-got/util"
+	"errors"
+	"strings"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	. "gopkg.in/telebot.v3"
+)
+
+// maxAudioSize is the max size of audio file of whisper api.
+const maxAudioSize = 25 << 20
+
+// audioFile is the audio of a voice, video note or audio message.
+type audioFile struct {
+	file     *File
+	name     string
+	duration int
+}
+
+func messageAudio(msg *Message) *audioFile {
+	switch {
+	case msg.Voice != nil:
+		return &audioFile{file: &msg.Voice.File, name: "voice.ogg", duration: msg.Voice.Duration}
+	case msg.VideoNote != nil:
+		return &audioFile{file: &msg.VideoNote.File, name: "video_note.mp4", duration: msg.VideoNote.Duration}
+	case msg.Audio != nil:
+		name := msg.Audio.FileName
+		if name == "" {
+			name = "audio.mp3"
+		}
+		return &audioFile{file: &msg.Audio.File, name: name, duration: msg.Audio.Duration}
+	}
+	return nil
+}
+
+func getTranscriber() (Transcriber, error) {
+	chatCfg := config.BotConfig.ChatConfig
+	name := chatCfg.TranscribeProvider
+	if name == "" {
+		name = chatCfg.Provider
+	}
+	p, ok := providers[name]
+	if !ok {
+		return nil, ErrProviderConfigInvalid
+	}
+	t, ok := p.(Transcriber)
+	if !ok {
+		return nil, errTranscribeNotSupported
+	}
+	return t, nil
+}
+
+// transcribe converts speech of audio to text.
+func transcribe(audio *audioFile) (string, error) {
+	chatCfg := config.BotConfig.ChatConfig
+	if audio.duration > chatCfg.TranscribeMaxDuration || audio.file.FileSize > maxAudioSize {
+		return "", errAudioTooLong
+	}
+	transcriber, err := getTranscriber()
+	if err != nil {
+		return "", err
+	}
+
+	reader, err := config.BotConfig.Bot.File(audio.file)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = reader.Close() }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	resp, err := transcriber.CreateTranscription(ctx, openai.AudioRequest{
+		Model:    chatCfg.TranscribeModel,
+		FilePath: audio.name,
+		Reader:   reader,
+		Language: chatCfg.TranscribeLanguage,
+	})
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(resp.Text), nil
+}
+
+// recordTranscribeUsage saves usage of transcription, which is priced by duration,
+// tokens of transcript are counted so that quota works.
+func recordTranscribeUsage(chatID, userID int64, audio *audioFile, text string) {
+	saveUsage(chatID, userID, &orm.ChatUsage{
+		CompletionTokens: int64(countTokens(text)),
+		Cost:             float64(audio.duration) / 60 * config.BotConfig.ChatConfig.TranscribePrice,
+	})
+}
+
+// replyTranscript transcribes audio and replies the transcript to msg, returns the transcript.
+// Usage is recorded for userID, who may not be the sender of msg.
+func replyTranscript(msg *Message, audio *audioFile, userID int64) (string, error) {
+	replyMsg, err := util.SendReplyWithError(msg.Chat, "正在识别...", msg)
+	if err != nil {
+		return "", err
+	}
+
+	text, err := transcribe(audio)
+	if err == nil {
+		recordTranscribeUsage(msg.Chat.ID, userID, audio, text)
+	}
+	switch {
+	case errors.Is(err, errAudioTooLong):
+		_, err = util.EditMessageWithError(replyMsg, "太长了，听不过来")
+		return "", err
+	case errors.Is(err, errTranscribeNotSupported), errors.Is(err, ErrProviderConfigInvalid):
+		_, err = util.EditMessageWithError(replyMsg, "没有配置语音识别哦")
+		return "", err
+	case err != nil:
+		log.Error("[ChatGPT] Can't transcribe audio", zap.Error(err))
+		_, err = util.EditMessageWithError(replyMsg, "没听清，再说一遍？")
+		return "", err
+	case text == "":
+		_, err = util.EditMessageWithError(replyMsg, "好像什么都没说")
+		return "", err
+	}
+
+	_, err = util.EditMessageWithError(replyMsg, text)
+	return text, err
+}
+
+const transcribeHelpInfo = "回复一条语音或者视频消息来识别它，`/transcribe -c` 可以把识别结果作为问题发给 /chat"
+
+// TranscribeHandler handle /transcribe command.
+func TranscribeHandler(ctx Context) error {
+	replyTo := ctx.Message().ReplyTo
+	if replyTo == nil {
+		return ctx.Reply(transcribeHelpInfo, ModeMarkdown)
+	}
+	audio := messageAudio(replyTo)
+	if audio == nil {
+		return ctx.Reply(transcribeHelpInfo, ModeMarkdown)
+	}
+
+	if reason, ok := checkQuota(ctx.Chat().ID, ctx.Sender().ID); !ok {
+		return ctx.Reply(reason)
+	}
+
+	text, err := replyTranscript(replyTo, audio, ctx.Sender().ID)
+	if err != nil || text == "" {
+		return err
+	}
+
+	command := entities.FromMessage(ctx.Message())
+	if command.Arg(0) == "-c" {
+		return startChat(ctx, getProvider(""), text, &chatOptions{})
+	}
+	return nil
+}
+
+// VoiceHandler transcribes voice automatically if `auto_transcribe` is enabled for the chat.
+func VoiceHandler(ctx Context) error {
+	audio := messageAudio(ctx.Message())
+	if audio == nil || ctx.Sender() == nil {
+		return nil
+	}
+	cfg, err := getChatConfig(ctx.Chat().ID)
+	if err != nil || !cfg.GetValueByKey("auto_transcribe").(bool) {
+		return nil
+	}
+	// don't reply reason of quota to every voice
+	if _, ok := checkQuota(ctx.Chat().ID, ctx.Sender().ID); !ok {
+		return nil
+	}
+	_, err = replyTranscript(ctx.Message(), audio, ctx.Sender().ID)
+	return err
+}
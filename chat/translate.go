@@ -0,0 +1,61 @@
+package chat
+
+import (
+	"context"
+	"csust-got/config"
+	"strings"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+const translatePrompt = "You are a prompt engineer of Stable Diffusion. " +
+	"Translate the user's description into an English prompt of Stable Diffusion, " +
+	"which is comma separated tags, such as `1girl, long hair, school uniform, cherry blossoms, sunset`. " +
+	"Expand it with a few tags of details, lighting and composition if the description is short. " +
+	"Keep tags which are already English, and keep weights and LoRAs such as `(red eyes:1.2)` and `<lora:name:1>` as is. " +
+	"Reply the prompt only, without any explanation."
+
+// TranslatePrompt translates prompt of stable diffusion into English tags by the default provider,
+// usage is counted into quota of user in chat, ErrQuotaExceeded is returned if it's used up.
+func TranslatePrompt(ctx context.Context, chatID, userID int64, prompt string) (string, error) {
+	provider := getProvider("")
+	if provider == nil {
+		return "", ErrNoProvider
+	}
+	if err := checkQuotaError(chatID, userID); err != nil {
+		return "", err
+	}
+	chatCfg := config.BotConfig.ChatConfig
+	model := openai.GPT3Dot5Turbo
+	if provider.Model() != "" {
+		model = provider.Model()
+	} else if chatCfg.Model != "" {
+		model = chatCfg.Model
+	}
+
+	maxTokens := chatCfg.MaxTokens
+	if maxTokens > 512 {
+		maxTokens = 512
+	}
+	req := openai.ChatCompletionRequest{
+		Model:     model,
+		MaxTokens: maxTokens,
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleSystem, Content: translatePrompt},
+			{Role: openai.ChatMessageRoleUser, Content: prompt},
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	resp, err := provider.CreateChatCompletion(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	addUsage(chatID, userID, model, &resp.Usage)
+	if len(resp.Choices) == 0 {
+		return "", errEmptyResponse
+	}
+	return strings.Trim(strings.TrimSpace(resp.Choices[0].Message.Content), "`"), nil
+}
@@ -0,0 +1,197 @@
+package chat
+
+import (
+	"csust-got/config"
+	"csust-got/log"
+	"csust-got/orm"
+	"csust-got/util"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	. "gopkg.in/telebot.v3"
+)
+
+const (
+	dailyUsageExpiration   = 40 * 24 * time.Hour
+	monthlyUsageExpiration = 400 * 24 * time.Hour
+)
+
+func dailyPeriod(t time.Time) string {
+	return "d" + t.In(util.TimeZoneCST).Format("20060102")
+}
+
+func monthlyPeriod(t time.Time) string {
+	return "m" + t.In(util.TimeZoneCST).Format("200601")
+}
+
+// calcCost calculates cost (US$) of usage by price table in config.
+func calcCost(model string, usage *openai.Usage) float64 {
+	price, ok := matchModel(config.BotConfig.ChatConfig.Prices, model)
+	if !ok {
+		return 0
+	}
+	return (float64(usage.PromptTokens)*price.Prompt + float64(usage.CompletionTokens)*price.Completion) / 1000
+}
+
+// estimateUsage estimates usage of response which has no usage returned, such as stream response.
+func estimateUsage(msgs []openai.ChatCompletionMessage, content string) openai.Usage {
+	usage := openai.Usage{
+		PromptTokens:     countMessagesTokens(msgs),
+		CompletionTokens: countTokens(content),
+	}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	return usage
+}
+
+// recordUsage saves usage of user and chat, and returns the cost.
+func recordUsage(ctx *chatContext, usage *openai.Usage) float64 {
+	return addUsage(ctx.Chat().ID, ctx.Sender().ID, ctx.req.Model, usage)
+}
+
+// addUsage saves token usage of model which is not a chat, such as embeddings, and returns the cost.
+func addUsage(chatID, userID int64, model string, usage *openai.Usage) float64 {
+	cost := calcCost(model, usage)
+	saveUsage(chatID, userID, &orm.ChatUsage{
+		PromptTokens:     int64(usage.PromptTokens),
+		CompletionTokens: int64(usage.CompletionTokens),
+		Cost:             cost,
+	})
+	return cost
+}
+
+func saveUsage(chatID, userID int64, usage *orm.ChatUsage) {
+	now := time.Now()
+	err := orm.AddChatUsage(chatID, userID, usage, map[string]time.Duration{
+		dailyPeriod(now):   dailyUsageExpiration,
+		monthlyPeriod(now): monthlyUsageExpiration,
+	})
+	if err != nil {
+		log.Error("[ChatGPT] Can't record usage", zap.Error(err))
+	}
+}
+
+// usageFooter is the usage info shown in debug mode.
+func usageFooter(usage *openai.Usage, cost float64, estimated bool) string {
+	footer := fmt.Sprintf("\n\nusage: %d + %d = %d", usage.PromptTokens, usage.CompletionTokens, usage.TotalTokens)
+	if estimated {
+		footer += " (estimated)"
+	}
+	footer += fmt.Sprintf("\nCredits spent (US$) : %.4f\n", cost)
+	return footer
+}
+
+// checkQuota checks if user or chat has used up the quota, returns the reason if used up.
+func checkQuota(chatID, userID int64) (string, bool) {
+	chatCfg := config.BotConfig.ChatConfig
+	now := time.Now()
+
+	type quotaItem struct {
+		quota  int64
+		get    func() (*orm.ChatUsage, error)
+		reason string
+	}
+	items := []quotaItem{
+		{chatCfg.UserDailyQuota, func() (*orm.ChatUsage, error) { return orm.GetUserChatUsage(userID, dailyPeriod(now)) },
+			"你今天的额度用完啦，明天再来吧"},
+		{chatCfg.UserMonthlyQuota, func() (*orm.ChatUsage, error) { return orm.GetUserChatUsage(userID, monthlyPeriod(now)) },
+			"你这个月的额度用完啦，下个月再来吧"},
+		{chatCfg.ChatDailyQuota, func() (*orm.ChatUsage, error) { return orm.GetChatUsage(chatID, dailyPeriod(now)) },
+			"本群今天的额度用完啦，明天再来吧"},
+		{chatCfg.ChatMonthlyQuota, func() (*orm.ChatUsage, error) { return orm.GetChatUsage(chatID, monthlyPeriod(now)) },
+			"本群这个月的额度用完啦，下个月再来吧"},
+	}
+	for _, item := range items {
+		if item.quota <= 0 {
+			continue
+		}
+		usage, err := item.get()
+		if err != nil {
+			continue
+		}
+		if usage.TotalTokens() >= item.quota {
+			return item.reason, false
+		}
+	}
+	return "", true
+}
+
+// checkQuotaError is checkQuota for callers which return error, the reason is wrapped in ErrQuotaExceeded.
+func checkQuotaError(chatID, userID int64) error {
+	if reason, ok := checkQuota(chatID, userID); !ok {
+		return fmt.Errorf("%w: %s", ErrQuotaExceeded, reason)
+	}
+	return nil
+}
+
+func formatUsage(usage *orm.ChatUsage, quota int64) string {
+	s := fmt.Sprintf("%d tokens (%d + %d), US$ %.4f",
+		usage.TotalTokens(), usage.PromptTokens, usage.CompletionTokens, usage.Cost)
+	if quota > 0 {
+		s += fmt.Sprintf(", 额度 %d/%d", usage.TotalTokens(), quota)
+	}
+	return s
+}
+
+// UsageHandler handle /chatusage command.
+func UsageHandler(ctx Context) error {
+	chatCfg := config.BotConfig.ChatConfig
+	now := time.Now()
+	day, month := dailyPeriod(now), monthlyPeriod(now)
+
+	var sb strings.Builder
+	userID := ctx.Sender().ID
+	userDaily, err := orm.GetUserChatUsage(userID, day)
+	if err != nil {
+		return ctx.Reply("完了，删库跑路了")
+	}
+	userMonthly, err := orm.GetUserChatUsage(userID, month)
+	if err != nil {
+		return ctx.Reply("完了，删库跑路了")
+	}
+	sb.WriteString("你的用量:\n")
+	sb.WriteString("  今日: " + formatUsage(userDaily, chatCfg.UserDailyQuota) + "\n")
+	sb.WriteString("  本月: " + formatUsage(userMonthly, chatCfg.UserMonthlyQuota) + "\n")
+
+	if ctx.Chat().Type != ChatPrivate {
+		chatID := ctx.Chat().ID
+		chatDaily, err := orm.GetChatUsage(chatID, day)
+		if err != nil {
+			return ctx.Reply("完了，删库跑路了")
+		}
+		chatMonthly, err := orm.GetChatUsage(chatID, month)
+		if err != nil {
+			return ctx.Reply("完了，删库跑路了")
+		}
+		sb.WriteString("\n本群用量:\n")
+		sb.WriteString("  今日: " + formatUsage(chatDaily, chatCfg.ChatDailyQuota) + "\n")
+		sb.WriteString("  本月: " + formatUsage(chatMonthly, chatCfg.ChatMonthlyQuota) + "\n")
+
+		rank, err := orm.GetChatUsageRank(chatID, month, 5)
+		if err == nil && len(rank) > 0 {
+			sb.WriteString("\n本月本群用量排行:\n")
+			for i, z := range rank {
+				sb.WriteString(fmt.Sprintf("  %d. %s: %d tokens\n", i+1, rankName(ctx.Chat(), z.Member), int64(z.Score)))
+			}
+		}
+	}
+
+	return ctx.Reply(sb.String())
+}
+
+// rankName returns name of member in usage rank, which is user id.
+func rankName(chat *Chat, member interface{}) string {
+	s := fmt.Sprint(member)
+	userID, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return s
+	}
+	chatMember, err := config.BotConfig.Bot.ChatMemberOf(chat, &User{ID: userID})
+	if err != nil || chatMember.User == nil {
+		return s
+	}
+	return util.GetName(chatMember.User)
+}
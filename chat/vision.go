@@ -0,0 +1,196 @@
+package chat
+
+import (
+	"csust-got/config"
+	"csust-got/log"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+
+	openai "github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+	. "gopkg.in/telebot.v3"
+)
+
+const (
+	// maxImageSize is the max size of image sent to model.
+	maxImageSize = 5 << 20
+	// imageTokens is the estimated tokens of an image, it's the cost of a 1024x1024 image in high detail.
+	imageTokens = 765
+	// imagePlaceholder is how an image is shown in plain text, such as summary.
+	imagePlaceholder = "[图片]"
+	// imageFilePrefix is the prefix of image url which refers to a telegram file,
+	// image is saved in context as telegram file, and it's downloaded when request is sent.
+	imageFilePrefix = "tg-file:"
+)
+
+// replyImage returns the photo or image document replied by msg, mime type of image is returned too.
+func replyImage(msg *Message) (*File, string) {
+	replyTo := msg.ReplyTo
+	if replyTo == nil {
+		return nil, ""
+	}
+	switch {
+	case replyTo.Photo != nil:
+		return &replyTo.Photo.File, "image/jpeg"
+	case replyTo.Document != nil && strings.HasPrefix(replyTo.Document.MIME, "image/"):
+		return &replyTo.Document.File, replyTo.Document.MIME
+	}
+	return nil, ""
+}
+
+// downloadImage downloads image from telegram, and returns it as data url.
+func downloadImage(file *File, mime string) (string, error) {
+	if file.FileSize > maxImageSize {
+		return "", errImageTooLarge
+	}
+	reader, err := config.BotConfig.Bot.File(file)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = reader.Close() }()
+
+	data, err := io.ReadAll(io.LimitReader(reader, maxImageSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxImageSize {
+		return "", errImageTooLarge
+	}
+	return fmt.Sprintf("data:%s;base64,%s", mime, base64.StdEncoding.EncodeToString(data)), nil
+}
+
+// imageFileURL returns image url which refers to file, it's `tg-file:<mime>:<file id>`.
+func imageFileURL(file *File, mime string) string {
+	return imageFilePrefix + mime + ":" + file.FileID
+}
+
+// parseImageFileURL returns file and mime type of image url, ok is false if url doesn't refer to a telegram file.
+func parseImageFileURL(url string) (file *File, mime string, ok bool) {
+	rest, ok := strings.CutPrefix(url, imageFilePrefix)
+	if !ok {
+		return nil, "", false
+	}
+	mime, fileID, ok := strings.Cut(rest, ":")
+	if !ok || fileID == "" {
+		return nil, "", false
+	}
+	return &File{FileID: fileID}, mime, true
+}
+
+// loadImages returns messages which images of telegram file are replaced by data url, messages without them are not copied.
+// Downloaded images are cached in images by url, and image which can't be downloaded is replaced by placeholder.
+func loadImages(msgs []openai.ChatCompletionMessage, images map[string]string) []openai.ChatCompletionMessage {
+	var loaded []openai.ChatCompletionMessage
+	for i := range msgs {
+		if !hasImageFile(&msgs[i]) {
+			continue
+		}
+		if loaded == nil {
+			loaded = make([]openai.ChatCompletionMessage, len(msgs))
+			copy(loaded, msgs)
+		}
+		parts := make([]openai.ChatMessagePart, 0, len(msgs[i].MultiContent))
+		for _, part := range msgs[i].MultiContent {
+			if part.Type != openai.ChatMessagePartTypeImageURL || part.ImageURL == nil {
+				parts = append(parts, part)
+				continue
+			}
+			url := part.ImageURL.URL
+			dataURL, ok := images[url]
+			if !ok {
+				if file, mime, isFile := parseImageFileURL(url); isFile {
+					var err error
+					dataURL, err = downloadImage(file, mime)
+					if err != nil {
+						log.Error("[ChatGPT] Can't download image in context", zap.Error(err))
+					}
+					images[url] = dataURL
+				} else {
+					dataURL = url
+				}
+			}
+			if dataURL == "" {
+				parts = append(parts, openai.ChatMessagePart{Type: openai.ChatMessagePartTypeText, Text: imagePlaceholder})
+				continue
+			}
+			image := *part.ImageURL
+			image.URL = dataURL
+			parts = append(parts, openai.ChatMessagePart{Type: part.Type, ImageURL: &image})
+		}
+		loaded[i].MultiContent = parts
+	}
+	if loaded == nil {
+		return msgs
+	}
+	return loaded
+}
+
+func hasImageFile(msg *openai.ChatCompletionMessage) bool {
+	for _, part := range msg.MultiContent {
+		if part.Type == openai.ChatMessagePartTypeImageURL && part.ImageURL != nil &&
+			strings.HasPrefix(part.ImageURL.URL, imageFilePrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// attachImage attaches image to the prompt (the last message) of request.
+func attachImage(req *openai.ChatCompletionRequest, imageURL string) {
+	prompt := &req.Messages[len(req.Messages)-1]
+	prompt.MultiContent = []openai.ChatMessagePart{
+		{Type: openai.ChatMessagePartTypeText, Text: prompt.Content},
+		{Type: openai.ChatMessagePartTypeImageURL, ImageURL: &openai.ChatMessageImageURL{URL: imageURL}},
+	}
+	prompt.Content = ""
+}
+
+// isVisionModel reports whether model can take image as input.
+func isVisionModel(model string) bool {
+	for _, prefix := range config.BotConfig.ChatConfig.VisionModels {
+		if strings.HasPrefix(model, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// messageText returns text of message, image is replaced by a placeholder.
+func messageText(msg *openai.ChatCompletionMessage) string {
+	if len(msg.MultiContent) == 0 {
+		return msg.Content
+	}
+	texts := make([]string, 0, len(msg.MultiContent))
+	for _, part := range msg.MultiContent {
+		switch part.Type {
+		case openai.ChatMessagePartTypeText:
+			texts = append(texts, part.Text)
+		case openai.ChatMessagePartTypeImageURL:
+			texts = append(texts, imagePlaceholder)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// stripImages returns messages which images are replaced by placeholder, messages without image are not copied.
+// Images can't be sent to model which is not a vision model.
+func stripImages(msgs []openai.ChatCompletionMessage) []openai.ChatCompletionMessage {
+	var stripped []openai.ChatCompletionMessage
+	for i := range msgs {
+		if len(msgs[i].MultiContent) == 0 {
+			continue
+		}
+		if stripped == nil {
+			stripped = make([]openai.ChatCompletionMessage, len(msgs))
+			copy(stripped, msgs)
+		}
+		stripped[i].Content = messageText(&msgs[i])
+		stripped[i].MultiContent = nil
+	}
+	if stripped == nil {
+		return msgs
+	}
+	return stripped
+}
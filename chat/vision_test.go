@@ -0,0 +1,58 @@
+package chat
+
+import (
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/stretchr/testify/require"
+	. "gopkg.in/telebot.v3"
+)
+
+func Test_stripImages(t *testing.T) {
+	text := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: "hello"}
+	msgs := []openai.ChatCompletionMessage{text}
+	require.Equal(t, msgs, stripImages(msgs))
+
+	image := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, MultiContent: []openai.ChatMessagePart{
+		{Type: openai.ChatMessagePartTypeText, Text: "what is it?"},
+		{Type: openai.ChatMessagePartTypeImageURL, ImageURL: &openai.ChatMessageImageURL{URL: "data:image/jpeg;base64,AAAA"}},
+	}}
+	msgs = []openai.ChatCompletionMessage{text, image}
+	stripped := stripImages(msgs)
+	require.Equal(t, []openai.ChatCompletionMessage{
+		text,
+		{Role: openai.ChatMessageRoleUser, Content: "what is it?\n" + imagePlaceholder},
+	}, stripped)
+	// original messages are not changed
+	require.Len(t, msgs[1].MultiContent, 2)
+}
+
+func Test_loadImages(t *testing.T) {
+	file := imageFileURL(&File{FileID: "AgAC-1_x"}, "image/png")
+	got, mime, ok := parseImageFileURL(file)
+	require.True(t, ok)
+	require.Equal(t, "AgAC-1_x", got.FileID)
+	require.Equal(t, "image/png", mime)
+	_, _, ok = parseImageFileURL("data:image/png;base64,AAAA")
+	require.False(t, ok)
+
+	text := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: "hello"}
+	msgs := []openai.ChatCompletionMessage{text}
+	require.Equal(t, msgs, loadImages(msgs, nil))
+
+	image := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, MultiContent: []openai.ChatMessagePart{
+		{Type: openai.ChatMessagePartTypeText, Text: "what is it?"},
+		{Type: openai.ChatMessagePartTypeImageURL, ImageURL: &openai.ChatMessageImageURL{URL: file}},
+	}}
+	msgs = []openai.ChatCompletionMessage{text, image}
+	// downloaded images are cached, and failed ones are empty
+	images := map[string]string{file: "data:image/png;base64,AAAA"}
+	loaded := loadImages(msgs, images)
+	require.Equal(t, "data:image/png;base64,AAAA", loaded[1].MultiContent[1].ImageURL.URL)
+	// original messages are not changed, so that telegram file is saved in context
+	require.Equal(t, file, msgs[1].MultiContent[1].ImageURL.URL)
+
+	images[file] = ""
+	loaded = loadImages(msgs, images)
+	require.Equal(t, openai.ChatMessagePart{Type: openai.ChatMessagePartTypeText, Text: imagePlaceholder}, loaded[1].MultiContent[1])
+}
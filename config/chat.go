@@ -1,6 +1,24 @@
 package config
 
-import "github.com/spf13/viper"
+import (
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// ProviderConfig is the config of a large language model backend.
+type ProviderConfig struct {
+	Name    string `mapstructure:"name"`
+	Type    string `mapstructure:"type"`
+	BaseURL string `mapstructure:"base_url"`
+	Key     string `mapstructure:"key"`
+	Model   string `mapstructure:"model"`
+}
+
+// ModelPrice is the price of model, US$ per 1K tokens.
+type ModelPrice struct {
+	Prompt     float64 `mapstructure:"prompt"`
+	Completion float64 `mapstructure:"completion"`
+}
 
 type chatConfig struct {
 	Key           string
@@ -12,6 +30,41 @@ type chatConfig struct {
 	Model         string
 	RetryNums     int
 	RetryInterval int
+
+	ContextWindow    int
+	ContextWindows   map[string]int
+	SummarizeContext bool
+
+	Prices           map[string]ModelPrice
+	UserDailyQuota   int64
+	UserMonthlyQuota int64
+	ChatDailyQuota   int64
+	ChatMonthlyQuota int64
+
+	Tools         []string
+	VisionModels  []string
+	AllowedModels []string
+
+	TranscribeProvider    string
+	TranscribeModel       string
+	TranscribeLanguage    string
+	TranscribeMaxDuration int
+	TranscribePrice       float64
+
+	KnowledgeProvider  string
+	EmbeddingModel     string
+	KnowledgeChunkSize int
+	KnowledgeTopK      int
+
+	SessionRetention int
+
+	Workers         int
+	QueueSize       int
+	UserConcurrency int
+
+	Provider  string
+	Providers []ProviderConfig
+	Commands  map[string]string
 }
 
 func (c *chatConfig) readConfig() {
@@ -24,6 +77,50 @@ func (c *chatConfig) readConfig() {
 	c.Model = viper.GetString("chatgpt.model")
 	c.RetryNums = viper.GetInt("chatgpt.retry_nums")
 	c.RetryInterval = viper.GetInt("chatgpt.retry_interval")
+
+	c.ContextWindow = viper.GetInt("chatgpt.context_window")
+	c.ContextWindows = make(map[string]int)
+	if err := viper.UnmarshalKey("chatgpt.context_windows", &c.ContextWindows); err != nil {
+		zap.L().Warn("chatgpt context windows config is invalid", zap.Error(err))
+	}
+	c.SummarizeContext = viper.GetBool("chatgpt.summarize_context")
+
+	c.Prices = make(map[string]ModelPrice)
+	if err := viper.UnmarshalKey("chatgpt.prices", &c.Prices); err != nil {
+		zap.L().Warn("chatgpt prices config is invalid", zap.Error(err))
+	}
+	c.UserDailyQuota = viper.GetInt64("chatgpt.quota.user_daily")
+	c.UserMonthlyQuota = viper.GetInt64("chatgpt.quota.user_monthly")
+	c.ChatDailyQuota = viper.GetInt64("chatgpt.quota.chat_daily")
+	c.ChatMonthlyQuota = viper.GetInt64("chatgpt.quota.chat_monthly")
+
+	c.Tools = viper.GetStringSlice("chatgpt.tools")
+	c.VisionModels = viper.GetStringSlice("chatgpt.vision_models")
+	c.AllowedModels = viper.GetStringSlice("chatgpt.allowed_models")
+
+	c.TranscribeProvider = viper.GetString("chatgpt.transcribe.provider")
+	c.TranscribeModel = viper.GetString("chatgpt.transcribe.model")
+	c.TranscribeLanguage = viper.GetString("chatgpt.transcribe.language")
+	c.TranscribeMaxDuration = viper.GetInt("chatgpt.transcribe.max_duration")
+	c.TranscribePrice = viper.GetFloat64("chatgpt.transcribe.price")
+
+	c.KnowledgeProvider = viper.GetString("chatgpt.knowledge.provider")
+	c.EmbeddingModel = viper.GetString("chatgpt.knowledge.embedding_model")
+	c.KnowledgeChunkSize = viper.GetInt("chatgpt.knowledge.chunk_size")
+	c.KnowledgeTopK = viper.GetInt("chatgpt.knowledge.top_k")
+
+	c.SessionRetention = viper.GetInt("chatgpt.session_retention")
+
+	c.Workers = viper.GetInt("chatgpt.workers")
+	c.QueueSize = viper.GetInt("chatgpt.queue_size")
+	c.UserConcurrency = viper.GetInt("chatgpt.user_concurrency")
+
+	c.Provider = viper.GetString("chatgpt.provider")
+	c.Providers = make([]ProviderConfig, 0)
+	if err := viper.UnmarshalKey("chatgpt.providers", &c.Providers); err != nil {
+		zap.L().Warn("chatgpt providers config is invalid", zap.Error(err))
+	}
+	c.Commands = viper.GetStringMapString("chatgpt.commands")
 }
 
 func (c *chatConfig) checkConfig() {
@@ -42,4 +139,67 @@ func (c *chatConfig) checkConfig() {
 	if c.RetryNums < 1 {
 		c.RetryNums = 1
 	}
+	if c.ContextWindow <= 0 {
+		c.ContextWindow = 4096
+	}
+	if c.TranscribeModel == "" {
+		c.TranscribeModel = "whisper-1"
+	}
+	if c.TranscribeMaxDuration <= 0 {
+		c.TranscribeMaxDuration = 300
+	}
+	if c.EmbeddingModel == "" {
+		c.EmbeddingModel = "text-embedding-3-small"
+	}
+	if c.KnowledgeChunkSize <= 0 {
+		c.KnowledgeChunkSize = 800
+	}
+	if c.KnowledgeTopK <= 0 {
+		c.KnowledgeTopK = 4
+	}
+	if c.SessionRetention <= 0 {
+		c.SessionRetention = 30
+	}
+	if c.Workers <= 0 {
+		c.Workers = 4
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = 16
+	}
+	if c.UserConcurrency <= 0 {
+		c.UserConcurrency = 1
+	}
+
+	// keep old config works, `chatgpt.key` is the key of openai.
+	if c.Key != "" && !c.hasProvider("openai") {
+		c.Providers = append(c.Providers, ProviderConfig{Name: "openai", Type: "openai", Key: c.Key})
+	}
+	if c.Commands == nil {
+		c.Commands = make(map[string]string)
+	}
+	// `/qiuchat` used the chat api of genshin voice server before.
+	if apiServer := BotConfig.GenShinConfig.ApiServer; apiServer != "" && !c.hasProvider("qiu") {
+		c.Providers = append(c.Providers, ProviderConfig{Name: "qiu", Type: "custom", BaseURL: apiServer + "/Chat"})
+	}
+	if _, ok := c.Commands["qiuchat"]; !ok && c.hasProvider("qiu") {
+		c.Commands["qiuchat"] = "qiu"
+	}
+	// qiu is a third-party server, it's only used by commands set explicitly, never by default.
+	if c.Provider == "" {
+		for _, p := range c.Providers {
+			if p.Name != "qiu" {
+				c.Provider = p.Name
+				break
+			}
+		}
+	}
+}
+
+func (c *chatConfig) hasProvider(name string) bool {
+	for _, p := range c.Providers {
+		if p.Name == name {
+			return true
+		}
+	}
+	return false
 }
@@ -47,6 +47,7 @@ func NewBotConfig() *Config {
 	config.BlockListConfig.SetName("black_list")
 	config.GenShinConfig = new(genShinConfig)
 	config.ChatConfig = new(chatConfig)
+	config.SDConfig = new(sdConfig)
 	return config
 }
 
@@ -69,6 +70,7 @@ type Config struct {
 	PromConfig      *promConfig
 	GenShinConfig   *genShinConfig
 	ChatConfig      *chatConfig
+	SDConfig        *sdConfig
 }
 
 // GetBot returns Bot.
@@ -110,6 +112,7 @@ func readConfig() {
 	BotConfig.BlockListConfig.readConfig()
 	BotConfig.PromConfig.readConfig()
 	BotConfig.ChatConfig.readConfig()
+	BotConfig.SDConfig.readConfig()
 
 	// genshin voice
 	BotConfig.GenShinConfig.readConfig()
@@ -136,4 +139,5 @@ func checkConfig() {
 	BotConfig.PromConfig.checkConfig()
 	BotConfig.GenShinConfig.checkConfig()
 	BotConfig.ChatConfig.checkConfig()
+	BotConfig.SDConfig.checkConfig()
 }
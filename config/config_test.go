@@ -202,3 +202,50 @@ func TestSpecialListConfig(t *testing.T) {
 	req.True(BotConfig.BlockListConfig.Enabled)
 	req.True(BotConfig.WhiteListConfig.Enabled)
 }
+
+func TestChatProviderConfig(t *testing.T) {
+	req := testInit(t)
+
+	// set some env
+	t.Setenv(testEnvPrefix+"_"+"TOKEN", "some-bot-token")
+	t.Setenv(testEnvPrefix+"_"+"REDIS_ADDR", "some-env-address")
+	t.Setenv(testEnvPrefix+"_"+"CHATGPT_KEY", "some-openai-key")
+
+	// init config
+	BotConfig = NewBotConfig()
+	initViper(testConfigFile, testEnvPrefix)
+	readConfig()
+	defer viper.Reset()
+	checkConfig()
+
+	// old config should be converted to providers
+	chatConfig := BotConfig.ChatConfig
+	req.Equal("openai", chatConfig.Provider)
+	req.Len(chatConfig.Providers, 2)
+	req.Equal(ProviderConfig{Name: "openai", Type: "openai", Key: "some-openai-key"}, chatConfig.Providers[0])
+	req.Equal(ProviderConfig{Name: "qiu", Type: "custom", BaseURL: "https://api.csu.st/Chat"}, chatConfig.Providers[1])
+	req.Equal("qiu", chatConfig.Commands["qiuchat"])
+}
+
+func TestChatProviderConfigWithoutKey(t *testing.T) {
+	req := testInit(t)
+
+	t.Setenv(testEnvPrefix+"_"+"TOKEN", "some-bot-token")
+	t.Setenv(testEnvPrefix+"_"+"REDIS_ADDR", "some-env-address")
+	t.Setenv(testEnvPrefix+"_"+"CHATGPT_PROVIDER", "")
+
+	BotConfig = NewBotConfig()
+	initViper(testConfigFile, testEnvPrefix)
+	readConfig()
+	defer viper.Reset()
+	checkConfig()
+	// config may be checked again
+	checkConfig()
+
+	// qiu is only for `/qiuchat`, chat is disabled without key
+	chatConfig := BotConfig.ChatConfig
+	req.Equal("", chatConfig.Provider)
+	req.Len(chatConfig.Providers, 1)
+	req.Equal("qiu", chatConfig.Providers[0].Name)
+	req.Equal("qiu", chatConfig.Commands["qiuchat"])
+}
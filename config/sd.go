@@ -0,0 +1,34 @@
+package config
+
+import (
+	"github.com/spf13/viper"
+)
+
+type sdConfig struct {
+	Admins              []int64
+	HealthCheckInterval int
+}
+
+func (c *sdConfig) readConfig() {
+	c.Admins = make([]int64, 0)
+	for _, id := range viper.GetIntSlice("stable_diffusion.admins") {
+		c.Admins = append(c.Admins, int64(id))
+	}
+	c.HealthCheckInterval = viper.GetInt("stable_diffusion.health_check_interval")
+}
+
+func (c *sdConfig) checkConfig() {
+	if c.HealthCheckInterval <= 0 {
+		c.HealthCheckInterval = 60
+	}
+}
+
+// IsAdmin reports whether user can manage stable diffusion servers.
+func (c *sdConfig) IsAdmin(userID int64) bool {
+	for _, id := range c.Admins {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
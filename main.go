@@ -44,6 +44,16 @@ func main() {
 	bot.Handle("/sd", sd.Handler)
 	bot.Handle("/sdcfg", sd.ConfigHandler)
 	bot.Handle("/sdlast", sd.LastPromptHandler)
+	bot.Handle("/sdservers", sd.ServersHandler)
+	bot.Handle("/sdredo", sd.RedoHandler)
+	bot.Handle("/sdqueue", sd.QueueHandler)
+	bot.Handle("/sdhistory", sd.HistoryHandler)
+	bot.Handle("/sdmodels", sd.ModelsHandler)
+	bot.Handle("/sdloras", sd.LorasHandler)
+	bot.Handle("/sdsamplers", sd.SamplersHandler)
+	bot.Handle(sd.BrowseButton, sd.BrowseCallback)
+	bot.Handle(sd.ResultButton, sd.ResultCallback)
+	bot.Handle(sd.HistoryButton, sd.HistoryCallback)
 
 	go sd.Process()
 
@@ -134,6 +144,19 @@ func registerBaseHandler(bot *Bot) {
 	bot.Handle("/chat", chat.GPTChat, whiteMiddleware)
 	bot.Handle("/chats", chat.GPTChatWithStream, whiteMiddleware)
 	bot.Handle("/qiuchat", chat.Cust, whiteMiddleware)
+	bot.Handle("/chatcfg", chat.ConfigHandler, whiteMiddleware)
+	bot.Handle("/chatusage", chat.UsageHandler, whiteMiddleware)
+	bot.Handle("/chatcancel", chat.CancelHandler, whiteMiddleware)
+	bot.Handle("/transcribe", chat.TranscribeHandler, whiteMiddleware)
+	bot.Handle("/kb", chat.KnowledgeHandler, whiteMiddleware)
+	bot.Handle("/ask", chat.Ask, whiteMiddleware)
+	bot.Handle("/prompt", chat.PromptHandler, whiteMiddleware)
+	bot.Handle("/p", chat.PromptChat, whiteMiddleware)
+	bot.Handle("/chatnew", chat.ChatNewHandler, whiteMiddleware)
+	bot.Handle("/chatlist", chat.ChatListHandler, whiteMiddleware)
+	bot.Handle("/chatswitch", chat.ChatSwitchHandler, whiteMiddleware)
+	bot.Handle("/chatexport", chat.ChatExportHandler, whiteMiddleware)
+	bot.Handle("/chatclear", chat.ChatClearHandler, whiteMiddleware)
 }
 
 func registerRestrictHandler(bot *Bot) {
@@ -152,14 +175,14 @@ func registerRestrictHandler(bot *Bot) {
 func registerEventHandler(bot *Bot) {
 	bot.Handle(OnUserJoined, base.WelcomeNewMember)
 	// bot.Handle(OnUserLeft, base.LeftMember)
-	bot.Handle(OnText, base.DoNothing)
+	bot.Handle(OnText, chat.ConversationHandler, whiteMiddleware)
 	bot.Handle(OnSticker, base.DoNothing)
 	bot.Handle(OnAnimation, base.DoNothing)
 	bot.Handle(OnMedia, base.DoNothing)
 	bot.Handle(OnPhoto, base.DoNothing)
 	bot.Handle(OnVideo, base.DoNothing)
-	bot.Handle(OnVoice, base.DoNothing)
-	bot.Handle(OnVideoNote, base.DoNothing)
+	bot.Handle(OnVoice, chat.VoiceHandler, whiteMiddleware)
+	bot.Handle(OnVideoNote, chat.VoiceHandler, whiteMiddleware)
 	bot.Handle(OnDocument, base.DoNothing)
 }
 
@@ -174,7 +197,8 @@ func skipMiddleware(next HandlerFunc) HandlerFunc {
 	skipSec := config.BotConfig.SkipDuration
 	return func(ctx Context) error {
 		m := ctx.Message()
-		if m == nil {
+		// message of callback is sent by bot, which may be old
+		if m == nil || ctx.Callback() != nil {
 			return next(ctx)
 		}
 		d := time.Since(m.Time())
@@ -206,6 +230,12 @@ func fakeBanMiddleware(next HandlerFunc) HandlerFunc {
 			return next(ctx)
 		}
 		if orm.IsBanned(ctx.Chat().ID, ctx.Sender().ID) {
+			if ctx.Callback() != nil {
+				// message of callback is sent by bot, just ignore the button
+				log.Info("callback ignored by fake ban", zap.String("chat", ctx.Chat().Title),
+					zap.String("user", ctx.Sender().Username))
+				return ctx.Respond()
+			}
 			util.DeleteMessage(ctx.Message())
 			log.Info("message deleted by fake ban", zap.String("chat", ctx.Chat().Title),
 				zap.String("user", ctx.Sender().Username))
@@ -220,6 +250,14 @@ func rateMiddleware(next HandlerFunc) HandlerFunc {
 		if !isChatMessageHasSender(ctx) || ctx.Chat().Type == ChatPrivate {
 			return next(ctx)
 		}
+		if ctx.Callback() != nil {
+			if !restrict.CheckCallbackLimit(ctx.Chat().ID, ctx.Sender().ID) {
+				log.Info("callback ignored by rate limit", zap.String("chat", ctx.Chat().Title),
+					zap.String("user", ctx.Sender().Username))
+				return ctx.Respond()
+			}
+			return next(ctx)
+		}
 		if !restrict.CheckLimit(ctx.Message()) {
 			log.Info("message deleted by rate limit", zap.String("chat", ctx.Chat().Title),
 				zap.String("user", ctx.Sender().Username))
@@ -244,7 +282,8 @@ func whiteMiddleware(next HandlerFunc) HandlerFunc {
 
 func noStickerMiddleware(next HandlerFunc) HandlerFunc {
 	return func(ctx Context) error {
-		if !isChatMessageHasSender(ctx) || ctx.Message().Sticker == nil {
+		// message of callback is sent by bot, not the sticker of sender
+		if !isChatMessageHasSender(ctx) || ctx.Callback() != nil || ctx.Message().Sticker == nil {
 			return next(ctx)
 		}
 		if !orm.IsShutdown(ctx.Chat().ID) && orm.IsNoStickerMode(ctx.Chat().ID) {
@@ -259,7 +298,7 @@ func noStickerMiddleware(next HandlerFunc) HandlerFunc {
 
 func promMiddleware(next HandlerFunc) HandlerFunc {
 	return func(ctx Context) error {
-		if ctx.Message() == nil {
+		if ctx.Message() == nil || ctx.Callback() != nil {
 			return next(ctx)
 		}
 		prom.DialContext(ctx)
@@ -277,7 +316,7 @@ func shutdownMiddleware(next HandlerFunc) HandlerFunc {
 		if !isChatMessageHasSender(ctx) {
 			return next(ctx)
 		}
-		if ctx.Message().Text != "" {
+		if ctx.Callback() == nil && ctx.Message().Text != "" {
 			cmd := entities.FromMessage(ctx.Message())
 			if cmd != nil && cmd.Name() == "boot" {
 				return next(ctx)
@@ -286,6 +325,9 @@ func shutdownMiddleware(next HandlerFunc) HandlerFunc {
 		if orm.IsShutdown(ctx.Chat().ID) {
 			log.Info("message ignore by shutdown", zap.String("chat", ctx.Chat().Title),
 				zap.String("user", ctx.Sender().Username))
+			if ctx.Callback() != nil {
+				return ctx.Respond()
+			}
 			return nil
 		}
 		return next(ctx)
@@ -589,14 +589,230 @@ func GetSDDefaultServer() string {
 	return defaultServer
 }
 
+// SetSDResult save request of stable diffusion result message.
+func SetSDResult(chatID int64, msgID int, result string, expire time.Duration) error {
+	err := rc.Set(context.TODO(), wrapKeyWithChatMsg("stable_diffusion_result", chatID, msgID), result, expire).Err()
+	if err != nil {
+		log.Error("set stable diffusion result to redis failed", zap.Int64("chat", chatID), zap.Int("msg", msgID), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// GetSDResult get request of stable diffusion result message.
+func GetSDResult(chatID int64, msgID int) (string, error) {
+	result, err := rc.Get(context.TODO(), wrapKeyWithChatMsg("stable_diffusion_result", chatID, msgID)).Result()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			log.Error("get stable diffusion result from redis failed", zap.Int64("chat", chatID), zap.Int("msg", msgID), zap.Error(err))
+		}
+		return "", err
+	}
+	return result, nil
+}
+
+// SetSDProfile save stable diffusion config as profile of user.
+func SetSDProfile(userID int64, name string, cfg string) error {
+	err := rc.HSet(context.TODO(), wrapKeyWithUser("stable_diffusion_profiles", userID), name, cfg).Err()
+	if err != nil {
+		log.Error("set stable diffusion profile to redis failed", zap.Int64("user", userID), zap.String("name", name), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// GetSDProfile get stable diffusion profile of user.
+func GetSDProfile(userID int64, name string) (string, error) {
+	cfg, err := rc.HGet(context.TODO(), wrapKeyWithUser("stable_diffusion_profiles", userID), name).Result()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			log.Error("get stable diffusion profile from redis failed", zap.Int64("user", userID), zap.String("name", name), zap.Error(err))
+		}
+		return "", err
+	}
+	return cfg, nil
+}
+
+// GetSDProfiles get names of stable diffusion profiles of user.
+func GetSDProfiles(userID int64) ([]string, error) {
+	names, err := rc.HKeys(context.TODO(), wrapKeyWithUser("stable_diffusion_profiles", userID)).Result()
+	if err != nil {
+		log.Error("get stable diffusion profiles from redis failed", zap.Int64("user", userID), zap.Error(err))
+		return nil, err
+	}
+	return names, nil
+}
+
+// DelSDProfile delete stable diffusion profile of user.
+func DelSDProfile(userID int64, name string) (bool, error) {
+	n, err := rc.HDel(context.TODO(), wrapKeyWithUser("stable_diffusion_profiles", userID), name).Result()
+	if err != nil {
+		log.Error("del stable diffusion profile from redis failed", zap.Int64("user", userID), zap.String("name", name), zap.Error(err))
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// SetSDSharedProfile save shared stable diffusion profile by code.
+func SetSDSharedProfile(code string, profile string, expire time.Duration) error {
+	err := rc.Set(context.TODO(), wrapKey("stable_diffusion::shared:"+code), profile, expire).Err()
+	if err != nil {
+		log.Error("set stable diffusion shared profile to redis failed", zap.String("code", code), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// GetSDSharedProfile get shared stable diffusion profile by code.
+func GetSDSharedProfile(code string) (string, error) {
+	profile, err := rc.Get(context.TODO(), wrapKey("stable_diffusion::shared:"+code)).Result()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			log.Error("get stable diffusion shared profile from redis failed", zap.String("code", code), zap.Error(err))
+		}
+		return "", err
+	}
+	return profile, nil
+}
+
+// NewSDJobID generate a new stable diffusion job id.
+func NewSDJobID() (int64, error) {
+	id, err := rc.Incr(context.TODO(), wrapKey("stable_diffusion::job_id")).Result()
+	if err != nil {
+		log.Error("generate stable diffusion job id failed", zap.Error(err))
+		return 0, err
+	}
+	return id, nil
+}
+
+// SetSDJob save stable diffusion job, set expire to 0 to keep it.
+func SetSDJob(id int64, job string, expire time.Duration) error {
+	err := rc.Set(context.TODO(), wrapKey("stable_diffusion::job:"+strconv.FormatInt(id, 10)), job, expire).Err()
+	if err != nil {
+		log.Error("set stable diffusion job to redis failed", zap.Int64("job", id), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// GetSDJob get stable diffusion job.
+func GetSDJob(id int64) (string, error) {
+	job, err := rc.Get(context.TODO(), wrapKey("stable_diffusion::job:"+strconv.FormatInt(id, 10))).Result()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			log.Error("get stable diffusion job from redis failed", zap.Int64("job", id), zap.Error(err))
+		}
+		return "", err
+	}
+	return job, nil
+}
+
+// AddSDJobID add id of unfinished stable diffusion job.
+func AddSDJobID(id int64) error {
+	err := rc.SAdd(context.TODO(), wrapKey("stable_diffusion::jobs"), id).Err()
+	if err != nil {
+		log.Error("add stable diffusion job id to redis failed", zap.Int64("job", id), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// DelSDJobID remove id of finished stable diffusion job.
+func DelSDJobID(id int64) error {
+	err := rc.SRem(context.TODO(), wrapKey("stable_diffusion::jobs"), id).Err()
+	if err != nil {
+		log.Error("del stable diffusion job id from redis failed", zap.Int64("job", id), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// GetSDJobIDs get ids of unfinished stable diffusion jobs.
+func GetSDJobIDs() ([]int64, error) {
+	members, err := rc.SMembers(context.TODO(), wrapKey("stable_diffusion::jobs")).Result()
+	if err != nil {
+		log.Error("get stable diffusion job ids from redis failed", zap.Error(err))
+		return nil, err
+	}
+	ids := make([]int64, 0, len(members))
+	for _, m := range members {
+		id, err := strconv.ParseInt(m, 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// SetSDServer add stable diffusion server to pool, or update its weight.
+func SetSDServer(addr string, weight int) error {
+	err := rc.HSet(context.TODO(), wrapKey("stable_diffusion::servers"), addr, weight).Err()
+	if err != nil {
+		log.Error("set stable diffusion server to redis failed", zap.String("server", addr), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// DelSDServer remove stable diffusion server from pool.
+func DelSDServer(addr string) (bool, error) {
+	n, err := rc.HDel(context.TODO(), wrapKey("stable_diffusion::servers"), addr).Result()
+	if err != nil {
+		log.Error("del stable diffusion server from redis failed", zap.String("server", addr), zap.Error(err))
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// GetSDServers get all stable diffusion servers in pool, server address -> weight.
+func GetSDServers() (map[string]int, error) {
+	m, err := rc.HGetAll(context.TODO(), wrapKey("stable_diffusion::servers")).Result()
+	if err != nil {
+		log.Error("get stable diffusion servers from redis failed", zap.Error(err))
+		return nil, err
+	}
+	servers := make(map[string]int, len(m))
+	for addr, v := range m {
+		weight, err := strconv.Atoi(v)
+		if err != nil || weight < 1 {
+			weight = 1
+		}
+		servers[addr] = weight
+	}
+	return servers, nil
+}
+
+// AddSDHistory add stable diffusion history of user, only the latest limit entries are kept.
+func AddSDHistory(userID int64, entry string, limit int64, expire time.Duration) error {
+	key := wrapKeyWithUser("stable_diffusion_history", userID)
+	pipe := rc.TxPipeline()
+	pipe.LPush(context.TODO(), key, entry)
+	pipe.LTrim(context.TODO(), key, 0, limit-1)
+	pipe.Expire(context.TODO(), key, expire)
+	_, err := pipe.Exec(context.TODO())
+	if err != nil {
+		log.Error("add stable diffusion history to redis failed", zap.Int64("user", userID), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// GetSDHistory get stable diffusion history of user, the latest is the first.
+func GetSDHistory(userID int64) ([]string, error) {
+	entries, err := rc.LRange(context.TODO(), wrapKeyWithUser("stable_diffusion_history", userID), 0, -1).Result()
+	if err != nil {
+		log.Error("get stable diffusion history from redis failed", zap.Int64("user", userID), zap.Error(err))
+		return nil, err
+	}
+	return entries, nil
+}
+
 // SetChatContext save user's chat context with GPT to redis.
 func SetChatContext(chatID int64, msgID int, chatContext []openai.ChatCompletionMessage) error {
 	if len(chatContext) == 0 {
 		return nil
 	}
-	if chatContext[0].Role == "system" {
-		chatContext = chatContext[1:]
-	}
 	chatContextJSON, err := json.Marshal(chatContext)
 	if err != nil {
 		log.Error("marshal chat context failed", zap.Int64("chat", chatID), zap.Int("msg", msgID), zap.Error(err))
@@ -627,3 +843,349 @@ func GetChatContext(chatID int64, msgID int) ([]openai.ChatCompletionMessage, er
 	}
 	return chatContext, nil
 }
+
+// SetChatConfig save chat config of GPT in a chat.
+func SetChatConfig(chatID int64, cfg string) error {
+	err := rc.Set(context.TODO(), wrapKeyWithChat("chat_config", chatID), cfg, 0).Err()
+	if err != nil {
+		log.Error("set chat config to redis failed", zap.Int64("chat", chatID), zap.String("config", cfg), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// GetChatConfig get chat config of GPT in a chat.
+func GetChatConfig(chatID int64) (string, error) {
+	cfg, err := rc.Get(context.TODO(), wrapKeyWithChat("chat_config", chatID)).Result()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			log.Error("get chat config from redis failed", zap.Int64("chat", chatID), zap.Error(err))
+		}
+		return "", err
+	}
+	return cfg, nil
+}
+
+// SetUserChatConfig save user's own chat config of GPT.
+func SetUserChatConfig(userID int64, cfg string) error {
+	err := rc.Set(context.TODO(), wrapKeyWithUser("chat_config", userID), cfg, 0).Err()
+	if err != nil {
+		log.Error("set user chat config to redis failed", zap.Int64("user", userID), zap.String("config", cfg), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// GetUserChatConfig get user's own chat config of GPT.
+func GetUserChatConfig(userID int64) (string, error) {
+	cfg, err := rc.Get(context.TODO(), wrapKeyWithUser("chat_config", userID)).Result()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			log.Error("get user chat config from redis failed", zap.Int64("user", userID), zap.Error(err))
+		}
+		return "", err
+	}
+	return cfg, nil
+}
+
+// ChatUsage is the usage of large language model.
+type ChatUsage struct {
+	PromptTokens     int64
+	CompletionTokens int64
+	Cost             float64
+}
+
+// TotalTokens returns total tokens of usage.
+func (u *ChatUsage) TotalTokens() int64 {
+	return u.PromptTokens + u.CompletionTokens
+}
+
+// AddChatUsage add usage of user in chat, periods are like `d20230417` or `m202304`.
+// Rank of chat is keyed by user id, since name of user may be changed or duplicated.
+func AddChatUsage(chatID, userID int64, usage *ChatUsage, periods map[string]time.Duration) error {
+	pipe := rc.TxPipeline()
+	for period, expiration := range periods {
+		keys := []string{
+			wrapKeyWithUser("chat_usage:"+period, userID),
+			wrapKeyWithChat("chat_usage:"+period, chatID),
+		}
+		for _, key := range keys {
+			pipe.HIncrBy(context.TODO(), key, "prompt", usage.PromptTokens)
+			pipe.HIncrBy(context.TODO(), key, "completion", usage.CompletionTokens)
+			pipe.HIncrByFloat(context.TODO(), key, "cost", usage.Cost)
+			pipe.Expire(context.TODO(), key, expiration)
+		}
+		rankKey := wrapKeyWithChat("chat_usage_rank:"+period, chatID)
+		pipe.ZIncrBy(context.TODO(), rankKey, float64(usage.TotalTokens()), strconv.FormatInt(userID, 10))
+		pipe.Expire(context.TODO(), rankKey, expiration)
+	}
+	_, err := pipe.Exec(context.TODO())
+	if err != nil {
+		log.Error("add chat usage to redis failed", zap.Int64("chat", chatID), zap.Int64("user", userID), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// GetUserChatUsage get usage of user in period.
+func GetUserChatUsage(userID int64, period string) (*ChatUsage, error) {
+	return getChatUsage(wrapKeyWithUser("chat_usage:"+period, userID))
+}
+
+// GetChatUsage get usage of chat in period.
+func GetChatUsage(chatID int64, period string) (*ChatUsage, error) {
+	return getChatUsage(wrapKeyWithChat("chat_usage:"+period, chatID))
+}
+
+func getChatUsage(key string) (*ChatUsage, error) {
+	usage := &ChatUsage{}
+	res, err := rc.HGetAll(context.TODO(), key).Result()
+	if err != nil {
+		log.Error("get chat usage from redis failed", zap.String("key", key), zap.Error(err))
+		return usage, err
+	}
+	usage.PromptTokens, _ = strconv.ParseInt(res["prompt"], 10, 64)
+	usage.CompletionTokens, _ = strconv.ParseInt(res["completion"], 10, 64)
+	usage.Cost, _ = strconv.ParseFloat(res["cost"], 64)
+	return usage, nil
+}
+
+// GetChatUsageRank get top n users who used most tokens in chat, member is user id.
+func GetChatUsageRank(chatID int64, period string, n int64) ([]redis.Z, error) {
+	rank, err := rc.ZRevRangeWithScores(context.TODO(), wrapKeyWithChat("chat_usage_rank:"+period, chatID), 0, n-1).Result()
+	if err != nil {
+		log.Error("get chat usage rank from redis failed", zap.Int64("chat", chatID), zap.Error(err))
+		return nil, err
+	}
+	return rank, nil
+}
+
+// NewKnowledgeID returns a new id of knowledge in chat.
+func NewKnowledgeID(chatID int64) (int64, error) {
+	id, err := rc.Incr(context.TODO(), wrapKeyWithChat("chat_kb_id", chatID)).Result()
+	if err != nil {
+		log.Error("incr knowledge id in redis failed", zap.Int64("chat", chatID), zap.Error(err))
+		return 0, err
+	}
+	return id, nil
+}
+
+// SetKnowledge save a knowledge (include its embeddings) in chat's knowledge base.
+func SetKnowledge(chatID int64, id int64, knowledge string) error {
+	err := rc.HSet(context.TODO(), wrapKeyWithChat("chat_kb", chatID), strconv.FormatInt(id, 10), knowledge).Err()
+	if err != nil {
+		log.Error("set knowledge to redis failed", zap.Int64("chat", chatID), zap.Int64("id", id), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// GetKnowledge get all knowledge in chat's knowledge base, returns map of id -> knowledge.
+func GetKnowledge(chatID int64) (map[string]string, error) {
+	res, err := rc.HGetAll(context.TODO(), wrapKeyWithChat("chat_kb", chatID)).Result()
+	if err != nil {
+		log.Error("get knowledge from redis failed", zap.Int64("chat", chatID), zap.Error(err))
+		return nil, err
+	}
+	return res, nil
+}
+
+// GetKnowledgeByID get a knowledge in chat's knowledge base.
+func GetKnowledgeByID(chatID int64, id int64) (string, error) {
+	res, err := rc.HGet(context.TODO(), wrapKeyWithChat("chat_kb", chatID), strconv.FormatInt(id, 10)).Result()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			log.Error("get knowledge from redis failed", zap.Int64("chat", chatID), zap.Int64("id", id), zap.Error(err))
+		}
+		return "", err
+	}
+	return res, nil
+}
+
+// DelKnowledge delete a knowledge from chat's knowledge base.
+func DelKnowledge(chatID int64, id int64) error {
+	err := rc.HDel(context.TODO(), wrapKeyWithChat("chat_kb", chatID), strconv.FormatInt(id, 10)).Err()
+	if err != nil {
+		log.Error("delete knowledge from redis failed", zap.Int64("chat", chatID), zap.Int64("id", id), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// SetChatPromptTemplate save a prompt template in chat.
+func SetChatPromptTemplate(chatID int64, name, template string) error {
+	return setPromptTemplate(wrapKeyWithChat("chat_prompt", chatID), name, template)
+}
+
+// GetChatPromptTemplates get all prompt templates in chat, returns map of name -> template.
+func GetChatPromptTemplates(chatID int64) (map[string]string, error) {
+	return getPromptTemplates(wrapKeyWithChat("chat_prompt", chatID))
+}
+
+// DelChatPromptTemplate delete a prompt template in chat, returns false if it not exists.
+func DelChatPromptTemplate(chatID int64, name string) (bool, error) {
+	return delPromptTemplate(wrapKeyWithChat("chat_prompt", chatID), name)
+}
+
+// SetUserPromptTemplate save user's own prompt template.
+func SetUserPromptTemplate(userID int64, name, template string) error {
+	return setPromptTemplate(wrapKeyWithUser("chat_prompt", userID), name, template)
+}
+
+// GetUserPromptTemplates get all user's own prompt templates, returns map of name -> template.
+func GetUserPromptTemplates(userID int64) (map[string]string, error) {
+	return getPromptTemplates(wrapKeyWithUser("chat_prompt", userID))
+}
+
+// DelUserPromptTemplate delete user's own prompt template, returns false if it not exists.
+func DelUserPromptTemplate(userID int64, name string) (bool, error) {
+	return delPromptTemplate(wrapKeyWithUser("chat_prompt", userID), name)
+}
+
+func setPromptTemplate(key, name, template string) error {
+	err := rc.HSet(context.TODO(), key, name, template).Err()
+	if err != nil {
+		log.Error("set prompt template to redis failed", zap.String("key", key), zap.String("name", name), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+func getPromptTemplates(key string) (map[string]string, error) {
+	res, err := rc.HGetAll(context.TODO(), key).Result()
+	if err != nil {
+		log.Error("get prompt templates from redis failed", zap.String("key", key), zap.Error(err))
+		return nil, err
+	}
+	return res, nil
+}
+
+func delPromptTemplate(key, name string) (bool, error) {
+	n, err := rc.HDel(context.TODO(), key, name).Result()
+	if err != nil {
+		log.Error("delete prompt template from redis failed", zap.String("key", key), zap.String("name", name), zap.Error(err))
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// SetChatSession save a named chat session of user, and refresh its expiration.
+func SetChatSession(userID int64, name, session string, expiration time.Duration) error {
+	pipe := rc.TxPipeline()
+	pipe.Set(context.TODO(), wrapKeyWithUser("chat_session:"+name, userID), session, expiration)
+	pipe.SAdd(context.TODO(), wrapKeyWithUser("chat_sessions", userID), name)
+	pipe.Expire(context.TODO(), wrapKeyWithUser("chat_sessions", userID), expiration)
+	_, err := pipe.Exec(context.TODO())
+	if err != nil {
+		log.Error("set chat session to redis failed", zap.Int64("user", userID), zap.String("name", name), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// UpdateChatSession update an existing named chat session of user by update, and refresh its expiration,
+// expiration of active session of user in chat is refreshed too if it's this session.
+// It's retried if the session is changed by others meanwhile, so that concurrent updates are not lost.
+func UpdateChatSession(chatID, userID int64, name string, update func(session string) (string, error), expiration time.Duration) error {
+	key := wrapKeyWithUser("chat_session:"+name, userID)
+	activeKey := wrapKeyWithChatMember("chat_session_active", chatID, userID)
+	txf := func(tx *redis.Tx) error {
+		session, err := tx.Get(context.TODO(), key).Result()
+		if err != nil {
+			return err
+		}
+		active, err := tx.Get(context.TODO(), activeKey).Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return err
+		}
+		session, err = update(session)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(context.TODO(), func(pipe redis.Pipeliner) error {
+			pipe.Set(context.TODO(), key, session, expiration)
+			pipe.Expire(context.TODO(), wrapKeyWithUser("chat_sessions", userID), expiration)
+			if active == name {
+				pipe.Expire(context.TODO(), activeKey, expiration)
+			}
+			return nil
+		})
+		return err
+	}
+
+	var err error
+	for i := 0; i < 5; i++ {
+		err = rc.Watch(context.TODO(), txf, key, activeKey)
+		if !errors.Is(err, redis.TxFailedErr) {
+			break
+		}
+	}
+	if err != nil && !errors.Is(err, redis.Nil) {
+		log.Error("update chat session in redis failed", zap.Int64("user", userID), zap.String("name", name), zap.Error(err))
+	}
+	return err
+}
+
+// GetChatSession get a named chat session of user.
+func GetChatSession(userID int64, name string) (string, error) {
+	session, err := rc.Get(context.TODO(), wrapKeyWithUser("chat_session:"+name, userID)).Result()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			log.Error("get chat session from redis failed", zap.Int64("user", userID), zap.String("name", name), zap.Error(err))
+		}
+		return "", err
+	}
+	return session, nil
+}
+
+// GetChatSessionNames get names of all chat sessions of user, some of them may be expired.
+func GetChatSessionNames(userID int64) ([]string, error) {
+	names, err := rc.SMembers(context.TODO(), wrapKeyWithUser("chat_sessions", userID)).Result()
+	if err != nil {
+		log.Error("get chat session names from redis failed", zap.Int64("user", userID), zap.Error(err))
+		return nil, err
+	}
+	return names, nil
+}
+
+// DelChatSession delete a named chat session of user.
+func DelChatSession(userID int64, name string) error {
+	pipe := rc.TxPipeline()
+	pipe.Del(context.TODO(), wrapKeyWithUser("chat_session:"+name, userID))
+	pipe.SRem(context.TODO(), wrapKeyWithUser("chat_sessions", userID), name)
+	_, err := pipe.Exec(context.TODO())
+	if err != nil {
+		log.Error("delete chat session from redis failed", zap.Int64("user", userID), zap.String("name", name), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// SetActiveChatSession set the active chat session of user in chat, empty name means no active session.
+func SetActiveChatSession(chatID, userID int64, name string, expiration time.Duration) error {
+	key := wrapKeyWithChatMember("chat_session_active", chatID, userID)
+	var err error
+	if name == "" {
+		err = rc.Del(context.TODO(), key).Err()
+	} else {
+		err = rc.Set(context.TODO(), key, name, expiration).Err()
+	}
+	if err != nil {
+		log.Error("set active chat session to redis failed", zap.Int64("chat", chatID), zap.Int64("user", userID),
+			zap.String("name", name), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// GetActiveChatSession get the active chat session of user in chat.
+func GetActiveChatSession(chatID, userID int64) (string, error) {
+	name, err := rc.Get(context.TODO(), wrapKeyWithChatMember("chat_session_active", chatID, userID)).Result()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			log.Error("get active chat session from redis failed", zap.Int64("chat", chatID), zap.Int64("user", userID), zap.Error(err))
+		}
+		return "", err
+	}
+	return name, nil
+}
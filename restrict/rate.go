@@ -16,18 +16,33 @@ var limitMap = make(map[string]*rate.Limiter, 16)
 
 // CheckLimit 限制消息发送的频率，以防止刷屏.
 func CheckLimit(m *Message) bool {
-	rateConfig := config.BotConfig.RateLimitConfig
-	key := strconv.FormatInt(m.Chat.ID, 10) + ":" + strconv.FormatInt(m.Sender.ID, 10)
+	limiter, ok := getLimiter(m.Chat.ID, m.Sender.ID)
+	if !ok || checkRate(m, limiter) {
+		return true
+	}
+	// 令牌不足撤回消息
+	util.DeleteMessage(m)
+	return false
+}
+
+// CheckCallbackLimit 限制按钮点击的频率，按钮消息是 bot 发的，所以不撤回.
+func CheckCallbackLimit(chatID, userID int64) bool {
+	limiter, ok := getLimiter(chatID, userID)
+	if !ok {
+		return true
+	}
+	return limiter.AllowN(time.Now(), config.BotConfig.RateLimitConfig.CommandCost)
+}
+
+// getLimiter returns limiter of user in chat, false if it's just created.
+func getLimiter(chatID, userID int64) (*rate.Limiter, bool) {
+	key := strconv.FormatInt(chatID, 10) + ":" + strconv.FormatInt(userID, 10)
 	if limiter, ok := limitMap[key]; ok {
-		if checkRate(m, limiter) {
-			return true
-		}
-		// 令牌不足撤回消息
-		util.DeleteMessage(m)
-		return false
+		return limiter, true
 	}
+	rateConfig := config.BotConfig.RateLimitConfig
 	limitMap[key] = rate.NewLimiter(rate.Limit(rateConfig.Limit), rateConfig.MaxToken)
-	return true
+	return limitMap[key], false
 }
 
 // return false if message should be limit.
@@ -0,0 +1,127 @@
+package sd
+
+import (
+	"csust-got/config"
+	"csust-got/log"
+	"csust-got/orm"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	. "gopkg.in/telebot.v3"
+)
+
+// upscaler is the upscaler of upscale action.
+const upscaler = "R-ESRGAN 4x+"
+
+// ResultButton is the inline button of actions on stable diffusion result.
+var ResultButton = &InlineButton{Unique: "sd_result"}
+
+const (
+	actionRegenerate = "regen"
+	actionNewSeed    = "seed"
+	actionUpscale    = "upscale"
+	actionHiRes      = "hr"
+	actionFile       = "file"
+)
+
+// sendActions sends a message with action buttons as reply of album,
+// request of job is saved for the message, so that actions can rerun it.
+func sendActions(job *StableDiffusionContext, info *generationInfo, msgs []Message) {
+	markup := &ReplyMarkup{}
+	rows := []Row{
+		markup.Row(markup.Data("🔄 重画", ResultButton.Unique, actionRegenerate),
+			markup.Data("🎲 换种子", ResultButton.Unique, actionNewSeed)),
+		markup.Row(markup.Data("🔍 放大×2", ResultButton.Unique, actionUpscale),
+			markup.Data("✨ 高清修复", ResultButton.Unique, actionHiRes)),
+	}
+	if job.UserConfig.GetValueByKey("format").(string) == "photo" {
+		// png with parameters has been sent in other formats
+		rows = append(rows, markup.Row(markup.Data("📄 原图", ResultButton.Unique, actionFile)))
+	}
+	markup.Inline(rows...)
+	msg, err := config.BotConfig.Bot.Reply(&msgs[0], fmt.Sprintf("任务 #%d 画完了", job.ID), markup)
+	if err != nil {
+		log.Error("send stable diffusion actions failed", zap.Error(err))
+		return
+	}
+
+	result := sdResult{Request: job.Request, InitFileID: job.InitFileID, Seed: info.Seed}
+	for i := range msgs {
+		switch {
+		case msgs[i].Photo != nil:
+			result.PhotoFileIDs = append(result.PhotoFileIDs, msgs[i].Photo.FileID)
+		case msgs[i].Document != nil:
+			result.PhotoFileIDs = append(result.PhotoFileIDs, msgs[i].Document.FileID)
+		}
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		log.Error("marshal stable diffusion result failed", zap.Error(err))
+		return
+	}
+	_ = orm.SetSDResult(msg.Chat.ID, msg.ID, string(data), resultRetention)
+}
+
+// ResultCallback handle action buttons of stable diffusion result, a new job is submitted as whom pressed the button.
+func ResultCallback(ctx Context) error {
+	msg := ctx.Message()
+	result, err := loadResult(msg.Chat.ID, msg.ID)
+	if errors.Is(err, redis.Nil) {
+		return ctx.Respond(&CallbackResponse{Text: "这组图的信息已经找不到了"})
+	}
+	if err != nil {
+		return ctx.Respond(&CallbackResponse{Text: "完了，删库跑路了"})
+	}
+
+	userConfig, err := getConfigByUserID(ctx.Sender().ID)
+	if err != nil {
+		return ctx.Respond(&CallbackResponse{Text: "完了，删库跑路了"})
+	}
+	if userConfig.GetServer() == "" && !pool.available() {
+		return ctx.Respond(&CallbackResponse{Text: "你还没有配置服务器，快使用 /sdcfg 配置一个吧", ShowAlert: true})
+	}
+
+	job := &StableDiffusionContext{
+		UserConfig: *userConfig,
+		Request:    result.Request,
+		InitFileID: result.InitFileID,
+	}
+	req := &job.Request
+	switch ctx.Data() {
+	case actionRegenerate:
+	case actionNewSeed:
+		req.Seed = -1
+	case actionUpscale:
+		if len(result.PhotoFileIDs) == 0 {
+			return ctx.Respond(&CallbackResponse{Text: "找不到要放大的图了"})
+		}
+		req.Upscale = 2
+		job.InitFileID = ""
+		job.UpscaleFileIDs = result.PhotoFileIDs
+	case actionHiRes:
+		if result.InitFileID != "" {
+			return ctx.Respond(&CallbackResponse{Text: "改图不支持高清修复"})
+		}
+		req.Seed = result.Seed
+		req.BatchSize = 1
+		req.HiResEnabled = true
+		req.DenoisingStrength = userConfig.GetValueByKey("denoising_strength").(float64)
+		req.HiResScale = userConfig.GetValueByKey("hr_scale").(float64)
+		req.HiResUpscaler = userConfig.GetValueByKey("hr_upscaler").(string)
+		req.HiResSecondPassSteps = userConfig.GetValueByKey("hr_second_pass_steps").(int)
+	case actionFile:
+		// images are not kept, they are drawn again with the same seed and sent as png files with parameters
+		req.Seed = result.Seed
+		job.UserConfig.Format = "document"
+	default:
+		return ctx.Respond()
+	}
+
+	if err = submit(ctx, job); err != nil {
+		log.Error("submit stable diffusion job failed", zap.Error(err))
+	}
+	return ctx.Respond()
+}
@@ -0,0 +1,295 @@
+package sd
+
+import (
+	"context"
+	"csust-got/log"
+	"csust-got/orm"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	. "gopkg.in/telebot.v3"
+)
+
+const browsePageSize = 8
+
+// BrowseButton is the inline button of model, lora and sampler browser.
+var BrowseButton = &InlineButton{Unique: "sd_browse"}
+
+// browseKind is what is browsed, and the config key set by choosing an item.
+type browseKind struct {
+	name  string
+	title string
+	path  string
+	key   string // empty if item can't be chosen
+	parse func(data []byte) ([]string, error)
+}
+
+var browseKinds = map[string]*browseKind{
+	"models": {
+		name:  "models",
+		title: "模型",
+		path:  "/sdapi/v1/sd-models",
+		key:   "model",
+		parse: func(data []byte) ([]string, error) {
+			var models []struct {
+				Title string `json:"title"`
+			}
+			err := json.Unmarshal(data, &models)
+			items := make([]string, 0, len(models))
+			for _, m := range models {
+				items = append(items, m.Title)
+			}
+			return items, err
+		},
+	},
+	"loras": {
+		name:  "loras",
+		title: "LoRA",
+		path:  "/sdapi/v1/loras",
+		parse: func(data []byte) ([]string, error) {
+			var loras []struct {
+				Name string `json:"name"`
+			}
+			err := json.Unmarshal(data, &loras)
+			items := make([]string, 0, len(loras))
+			for _, l := range loras {
+				items = append(items, fmt.Sprintf("<lora:%s:1>", l.Name))
+			}
+			return items, err
+		},
+	},
+	"samplers": {
+		name:  "samplers",
+		title: "采样器",
+		path:  "/sdapi/v1/samplers",
+		key:   "sampler",
+		parse: func(data []byte) ([]string, error) {
+			var samplers []struct {
+				Name string `json:"name"`
+			}
+			err := json.Unmarshal(data, &samplers)
+			items := make([]string, 0, len(samplers))
+			for _, s := range samplers {
+				items = append(items, s.Name)
+			}
+			return items, err
+		},
+	},
+}
+
+// list returns items on servers which jobs of user may run on. If user has no server, job may run on
+// any healthy server in pool, so only items which every healthy server has are returned.
+func (k *browseKind) list(config *StableDiffusionConfig) ([]string, error) {
+	if config.Server != "" {
+		return k.fetch(config.Server)
+	}
+	addrs := pool.healthyServers()
+	if len(addrs) == 0 {
+		return k.fetch(orm.GetSDDefaultServer())
+	}
+
+	lists := make([][]string, len(addrs))
+	errs := make([]error, len(addrs))
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			lists[i], errs[i] = k.fetch(addr)
+		}(i, addr)
+	}
+	wg.Wait()
+
+	var items []string
+	fetched := false
+	for i := range addrs {
+		if errs[i] != nil {
+			// server is down, jobs won't run on it
+			log.Warn("fetch stable diffusion list failed", zap.String("server", addrs[i]), zap.Error(errs[i]))
+			continue
+		}
+		if !fetched {
+			items, fetched = lists[i], true
+			continue
+		}
+		has := make(map[string]bool, len(lists[i]))
+		for _, item := range lists[i] {
+			has[item] = true
+		}
+		common := items[:0:0]
+		for _, item := range items {
+			if has[item] {
+				common = append(common, item)
+			}
+		}
+		items = common
+	}
+	if !fetched {
+		return nil, errs[0]
+	}
+	return items, nil
+}
+
+func (k *browseKind) fetch(addr string) ([]string, error) {
+	if addr == "" {
+		return nil, ErrServerNotConfigured
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, addr+k.path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrServerNotAvailable, err.Error())
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: status code %d", ErrRequestNotOK, resp.StatusCode)
+	}
+	var data json.RawMessage
+	if err = json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	return k.parse(data)
+}
+
+// render returns text and keyboard of page, items can be chosen by buttons if kind has key.
+func (k *browseKind) render(items []string, page int, current string) (string, *ReplyMarkup) {
+	pages := (len(items) + browsePageSize - 1) / browsePageSize
+	if page >= pages {
+		page = pages - 1
+	}
+	if page < 0 {
+		page = 0
+	}
+
+	markup := &ReplyMarkup{}
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("%s (%d/%d)\n", k.title, page+1, pages))
+	var rows []Row
+	for i := page * browsePageSize; i < len(items) && i < (page+1)*browsePageSize; i++ {
+		mark := ""
+		if items[i] == current {
+			mark = " ✅"
+		}
+		sb.WriteString(fmt.Sprintf("%d. %s%s\n", i+1, items[i], mark))
+		if k.key != "" {
+			rows = append(rows, markup.Row(markup.Data(fmt.Sprintf("%d. %s", i+1, items[i]), BrowseButton.Unique,
+				k.name, "set", strconv.Itoa(i), strconv.Itoa(page))))
+		}
+	}
+	if k.key != "" {
+		sb.WriteString("\n点击按钮切换")
+	}
+
+	var nav []Btn
+	if page > 0 {
+		nav = append(nav, markup.Data("⬅️", BrowseButton.Unique, k.name, "page", strconv.Itoa(page-1)))
+	}
+	if page < pages-1 {
+		nav = append(nav, markup.Data("➡️", BrowseButton.Unique, k.name, "page", strconv.Itoa(page+1)))
+	}
+	if len(nav) > 0 {
+		rows = append(rows, markup.Row(nav...))
+	}
+	markup.Inline(rows...)
+	return sb.String(), markup
+}
+
+func (k *browseKind) current(config *StableDiffusionConfig) string {
+	if k.key == "" {
+		return ""
+	}
+	v, _ := config.GetValueByKey(k.key).(string)
+	return v
+}
+
+func browse(ctx Context, kind string) error {
+	k := browseKinds[kind]
+	config, err := getConfigByUserID(ctx.Sender().ID)
+	if err != nil {
+		return ctx.Reply("完了，删库跑路了")
+	}
+	items, err := k.list(config)
+	if err != nil {
+		log.Error("fetch stable diffusion list failed", zap.String("kind", kind), zap.Error(err))
+		return ctx.Reply("服务器寄了，拿不到列表")
+	}
+	if len(items) == 0 && config.Server == "" && pool.available() {
+		return ctx.Reply(fmt.Sprintf("服务器池里没有每台服务器都有的%s", k.title))
+	}
+	if len(items) == 0 {
+		return ctx.Reply(fmt.Sprintf("服务器上没有%s", k.title))
+	}
+	text, markup := k.render(items, 0, k.current(config))
+	return ctx.Reply(text, markup)
+}
+
+// ModelsHandler handle /sdmodels command.
+func ModelsHandler(ctx Context) error {
+	return browse(ctx, "models")
+}
+
+// LorasHandler handle /sdloras command.
+func LorasHandler(ctx Context) error {
+	return browse(ctx, "loras")
+}
+
+// SamplersHandler handle /sdsamplers command.
+func SamplersHandler(ctx Context) error {
+	return browse(ctx, "samplers")
+}
+
+// BrowseCallback handle buttons of browser, `<kind>|page|<page>` turns page, `<kind>|set|<index>|<page>` chooses item.
+// Anyone can choose item, which is saved to config of whom pressed the button.
+func BrowseCallback(ctx Context) error {
+	args := strings.Split(ctx.Data(), "|")
+	if len(args) < 3 {
+		return ctx.Respond()
+	}
+	k, ok := browseKinds[args[0]]
+	if !ok {
+		return ctx.Respond()
+	}
+
+	userID := ctx.Sender().ID
+	config, err := getConfigByUserID(userID)
+	if err != nil {
+		return ctx.Respond(&CallbackResponse{Text: "完了，删库跑路了"})
+	}
+	items, err := k.list(config)
+	if err != nil || len(items) == 0 {
+		return ctx.Respond(&CallbackResponse{Text: "服务器寄了，拿不到列表"})
+	}
+
+	page, _ := strconv.Atoi(args[2])
+	resp := &CallbackResponse{}
+	if args[1] == "set" && k.key != "" && len(args) > 3 {
+		i, err := strconv.Atoi(args[2])
+		if err != nil || i < 0 || i >= len(items) {
+			return ctx.Respond(&CallbackResponse{Text: "列表变了，重新打开看看吧"})
+		}
+		if err = config.SetValueByKey(k.key, items[i]); err != nil {
+			return ctx.Respond(&CallbackResponse{Text: err.Error()})
+		}
+		if err = saveConfig(userID, config); err != nil {
+			return ctx.Respond(&CallbackResponse{Text: "完了，删库跑路了"})
+		}
+		resp.Text = "已切换到 " + items[i]
+		page, _ = strconv.Atoi(args[3])
+	}
+
+	text, markup := k.render(items, page, k.current(config))
+	if err = ctx.Edit(text, markup); err != nil {
+		log.Debug("edit stable diffusion browser failed", zap.Error(err))
+	}
+	return ctx.Respond(resp)
+}
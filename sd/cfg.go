@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 
@@ -24,12 +25,18 @@ type StableDiffusionConfig struct {
 	Height         int    `json:"height"`
 	Number         int    `json:"number"`
 	Sampler        string `json:"sampler"`
+	Seed           int64  `json:"seed"`
+	Model          string `json:"model"`
 
 	HiResEnabled         string  `json:"hr"`
 	DenoisingStrength    float64 `json:"denoising_strength"`
 	HiResScale           float64 `json:"hr_scale"`
 	HiResUpscaler        string  `json:"hr_upscaler"`
 	HiResSecondPassSteps int     `json:"hr_second_pass_steps"`
+
+	Preview   string `json:"preview"`
+	Translate string `json:"translate"`
+	Format    string `json:"format"`
 }
 
 // GetValueByKey get value by key.
@@ -81,6 +88,16 @@ func (c *StableDiffusionConfig) GetValueByKey(key string) interface{} {
 			return "Euler a"
 		}
 		return c.Sampler
+	case key == "model":
+		if c.Model == "" {
+			return "default"
+		}
+		return c.Model
+	case key == "seed":
+		if c.Seed == 0 {
+			return int64(-1)
+		}
+		return c.Seed
 	case key == "hr":
 		if c.HiResEnabled == "" {
 			return "off"
@@ -106,6 +123,21 @@ func (c *StableDiffusionConfig) GetValueByKey(key string) interface{} {
 			return 20
 		}
 		return c.HiResSecondPassSteps
+	case key == "preview":
+		if c.Preview == "" {
+			return "off"
+		}
+		return c.Preview
+	case key == "translate":
+		if c.Translate == "" {
+			return "off"
+		}
+		return c.Translate
+	case key == "format":
+		if c.Format == "" {
+			return "photo"
+		}
+		return c.Format
 	default:
 		return "key not exists"
 	}
@@ -185,6 +217,24 @@ func (c *StableDiffusionConfig) SetValueByKey(key string, value string) error {
 			value = "Euler a"
 		}
 		c.Sampler = value
+	case key == "model":
+		if value == "*" || value == "default" {
+			value = ""
+		}
+		c.Model = value
+	case key == "seed":
+		if value == "*" || value == "-1" {
+			c.Seed = 0
+			return nil
+		}
+		seed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: seed must be a integer", ErrConfigIsInvalid)
+		}
+		if seed < 1 || seed > math.MaxUint32 {
+			return fmt.Errorf("%w: seed must be between 1 and %d, or -1 for random", ErrConfigIsInvalid, uint32(math.MaxUint32))
+		}
+		c.Seed = seed
 	case key == "hr":
 		if value == "on" {
 			c.HiResEnabled = "on"
@@ -223,6 +273,27 @@ func (c *StableDiffusionConfig) SetValueByKey(key string, value string) error {
 		if c.HiResSecondPassSteps < 0 || c.HiResSecondPassSteps > 50 {
 			return fmt.Errorf("%w: hr_second_pass_steps too small or too large", ErrConfigIsInvalid)
 		}
+	case key == "preview":
+		if value == "on" {
+			c.Preview = "on"
+		} else {
+			c.Preview = "off"
+		}
+	case key == "translate":
+		if value == "on" {
+			c.Translate = "on"
+		} else {
+			c.Translate = "off"
+		}
+	case key == "format":
+		switch value {
+		case "*":
+			c.Format = ""
+		case "photo", "document", "both":
+			c.Format = value
+		default:
+			return fmt.Errorf("%w: format must be one of photo, document and both", ErrConfigIsInvalid)
+		}
 	default:
 		return fmt.Errorf("%w: invalid key: %s", ErrConfigIsInvalid, key)
 	}
@@ -250,6 +321,11 @@ func (c *StableDiffusionConfig) GenStableDiffusionRequest() *StableDiffusionReq
 		Height:         c.GetValueByKey("height").(int),
 		BatchSize:      c.GetValueByKey("number").(int),
 		SamplerIndex:   c.GetValueByKey("sampler").(string),
+		Seed:           c.GetValueByKey("seed").(int64),
+		Subseed:        -1,
+	}
+	if c.Model != "" {
+		req.OverrideSettings = map[string]interface{}{"sd_model_checkpoint": c.Model}
 	}
 	if c.GetValueByKey("hr").(string) == "on" {
 		req.HiResEnabled = true
@@ -264,6 +340,9 @@ func (c *StableDiffusionConfig) GenStableDiffusionRequest() *StableDiffusionReq
 
 const helpInfo = "sdcfg set \\<key\\> \\<value\\>\n" +
 	"sdcfg get \\<key\\>\n" +
+	"sdcfg profile save\\|load\\|list\\|rm \\<name\\>\n" +
+	"sdcfg share \\[name\\]\n" +
+	"sdcfg import \\<code\\> \\[name\\]\n" +
 	"available keys: \n" +
 	"`server`: your own stable diffusion server address\\(write only\\)\\.\n" +
 	"`prompt`: your default prompt, will add to your every command call\\.\n" +
@@ -272,16 +351,24 @@ const helpInfo = "sdcfg set \\<key\\> \\<value\\>\n" +
 	"`scale`: scale for stable diffusion\\.\n" +
 	"`res`: resolution __width__x__height__\\.\n" +
 	"`number`: number of images for once command call\\.\n" +
-	"`sampler`: sampler for stable diffusion, default is `Euler a`\\.\n" +
+	"`model`: checkpoint for stable diffusion, `default` to use model of server, see /sdmodels\\.\n" +
+	"`sampler`: sampler for stable diffusion, default is `Euler a`, see /sdsamplers\\.\n" +
+	"`seed`: seed for stable diffusion, `\\-1` for random\\.\n" +
 	"`hr`: high resolution fix `on`/`off`, will force `number` to 1\\.\n" +
-	"`denoising_strength`: denoising strength for high resolution\\.\n" +
+	"`denoising_strength`: denoising strength for high resolution and img2img\\.\n" +
 	"`hr_scale`: high resolution scale\\.\n" +
 	"`hr_upscaler`: high resolution upscaler, default is `Latent`\\.\n" +
-	"`hr_second_pass_steps`: high resolution fix steps\\."
+	"`hr_second_pass_steps`: high resolution fix steps\\.\n" +
+	"`preview`: show preview image while drawing `on`/`off`\\.\n" +
+	"`translate`: translate prompt which is not English into tags by AI before drawing `on`/`off`\\.\n" +
+	"`format`: send images as `photo`, `document` which is lossless png with parameters, or `both`\\."
 
 const (
-	sdSubCmdSet = "set"
-	sdSubCmdGet = "get"
+	sdSubCmdSet     = "set"
+	sdSubCmdGet     = "get"
+	sdSubCmdProfile = "profile"
+	sdSubCmdShare   = "share"
+	sdSubCmdImport  = "import"
 )
 
 // ConfigHandler handle /sdcfg command.
@@ -300,6 +387,12 @@ func ConfigHandler(ctx Context) error {
 
 	var mode, key, value string
 	switch command.Arg(0) {
+	case sdSubCmdProfile:
+		return profileHandler(ctx, command, config)
+	case sdSubCmdShare:
+		return shareHandler(ctx, command, config)
+	case sdSubCmdImport:
+		return importHandler(ctx, command)
 	case sdSubCmdSet:
 		if command.Argc() < 3 {
 			return ctx.Reply(helpInfo, ModeMarkdownV2)
@@ -330,11 +423,7 @@ func ConfigHandler(ctx Context) error {
 		if err != nil {
 			return ctx.Reply(err.Error())
 		}
-		configStr, err := json.MarshalIndent(&config, "", "")
-		if err != nil {
-			return ctx.Reply("感觉有点问题")
-		}
-		err = orm.SetSDConfig(userID, string(configStr))
+		err = saveConfig(userID, config)
 		if err != nil {
 			return ctx.Reply("完了，删库跑路了")
 		}
@@ -1,10 +1,74 @@
 package sd
 
-import . "gopkg.in/telebot.v3"
+import (
+	"context"
+	"csust-got/config"
 
-// StableDiffusionContext is the context of stable diffusion worker.
+	. "gopkg.in/telebot.v3"
+)
+
+type jobState string
+
+const (
+	jobPending  jobState = "pending"
+	jobRunning  jobState = "running"
+	jobDone     jobState = "done"
+	jobFailed   jobState = "failed"
+	jobCanceled jobState = "canceled"
+)
+
+// StableDiffusionContext is a stable diffusion job, it's saved in redis so that it can be resumed after restart.
 type StableDiffusionContext struct {
-	BotContext Context
-	UserConfig StableDiffusionConfig
-	Request    StableDiffusionReq
+	ID         int64                 `json:"id"`
+	ChatID     int64                 `json:"chat_id"`
+	UserID     int64                 `json:"user_id"`
+	MsgID      int                   `json:"msg_id"`
+	UserConfig StableDiffusionConfig `json:"user_config"`
+	// Request has no init images, which is downloaded by InitFileID when job runs.
+	Request StableDiffusionReq `json:"request"`
+	// InitFileID is file id of init image for img2img.
+	InitFileID string `json:"init_file_id,omitempty"`
+	// UpscaleFileIDs are file ids of images to upscale.
+	UpscaleFileIDs []string `json:"upscale_file_ids,omitempty"`
+	// TranslatePrompt is prompt of user which is translated and appended to Request when job runs.
+	TranslatePrompt string `json:"translate_prompt,omitempty"`
+
+	State     jobState `json:"state"`
+	CreatedAt int64    `json:"created_at"`
+
+	// StatusMsgID is id of message which shows progress of job, 0 if it's not sent.
+	StatusMsgID int `json:"status_msg_id,omitempty"`
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	// tried is pooled servers which are not available for job, job is moved to other servers.
+	tried map[string]bool
+}
+
+func (j *StableDiffusionContext) chat() *Chat {
+	return &Chat{ID: j.ChatID}
+}
+
+// reply sends what as a reply of command message.
+func (j *StableDiffusionContext) reply(what interface{}, opts ...interface{}) (*Message, error) {
+	// send options must be the first, since it overrides options before it
+	opts = append([]interface{}{j.replyOptions()}, opts...)
+	return config.BotConfig.Bot.Send(j.chat(), what, opts...)
+}
+
+// sendAlbum sends album as a reply of command message.
+func (j *StableDiffusionContext) sendAlbum(album Album) ([]Message, error) {
+	return config.BotConfig.Bot.SendAlbum(j.chat(), album, j.replyOptions())
+}
+
+func (j *StableDiffusionContext) replyOptions() *SendOptions {
+	return &SendOptions{ReplyTo: &Message{ID: j.MsgID, Chat: j.chat()}, AllowWithoutReply: true}
+}
+
+// statusMsg returns the status message, nil if it's not sent.
+func (j *StableDiffusionContext) statusMsg() *Message {
+	if j.StatusMsgID == 0 {
+		return nil
+	}
+	return &Message{ID: j.StatusMsgID, Chat: j.chat()}
 }
@@ -9,4 +9,8 @@ var (
 	ErrConfigKeyNotSupport = errors.New("config key not support")
 	ErrConfigIsInvalid     = errors.New("config is invalid")
 	ErrRequestNotOK        = errors.New("request not ok")
+	ErrImageTooLarge       = errors.New("image is too large")
+	ErrNoServerAvailable   = errors.New("no server available")
+	ErrTooManyJobs         = errors.New("too many jobs")
+	ErrQueueFull           = errors.New("queue is full")
 )
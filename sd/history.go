@@ -0,0 +1,278 @@
+package sd
+
+import (
+	"csust-got/entities"
+	"csust-got/log"
+	"csust-got/orm"
+	"csust-got/util"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	. "gopkg.in/telebot.v3"
+)
+
+const (
+	// historyLimit is the max history entries kept for a user.
+	historyLimit = 50
+	// historyRetention is how long history is kept since the last generation of user.
+	historyRetention = 30 * 24 * time.Hour
+	// historyPromptLength is the max runes of prompt shown in history.
+	historyPromptLength = 300
+)
+
+// HistoryButton is the inline button of history gallery.
+var HistoryButton = &InlineButton{Unique: "sd_history"}
+
+const (
+	historyPage  = "page"
+	historyShow  = "show"
+	historyRerun = "rerun"
+)
+
+// historyEntry is a finished generation of user, Request has seed of the first image so that it can be rerun.
+type historyEntry struct {
+	JobID      int64              `json:"job_id"`
+	CreatedAt  int64              `json:"created_at"`
+	Request    StableDiffusionReq `json:"request"`
+	InitFileID string             `json:"init_file_id,omitempty"`
+	FileIDs    []string           `json:"file_ids"`
+	// Documents is true if results are sent as documents instead of photos.
+	Documents bool   `json:"documents,omitempty"`
+	Model     string `json:"model,omitempty"`
+}
+
+// addHistory appends finished job to history of user.
+func addHistory(job *StableDiffusionContext, info *generationInfo, msgs []Message) {
+	entry := historyEntry{
+		JobID:      job.ID,
+		CreatedAt:  time.Now().Unix(),
+		Request:    job.Request,
+		InitFileID: job.InitFileID,
+		Model:      info.SDModelName,
+	}
+	entry.Request.Seed, entry.Request.Subseed = info.seedAt(0)
+	entry.Request.SubseedStrength = info.SubseedStrength
+	for i := range msgs {
+		switch {
+		case msgs[i].Photo != nil:
+			entry.FileIDs = append(entry.FileIDs, msgs[i].Photo.FileID)
+		case msgs[i].Document != nil:
+			entry.FileIDs = append(entry.FileIDs, msgs[i].Document.FileID)
+			entry.Documents = true
+		}
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Error("marshal stable diffusion history failed", zap.Error(err))
+		return
+	}
+	_ = orm.AddSDHistory(job.UserID, string(data), historyLimit, historyRetention)
+}
+
+func loadHistory(userID int64) ([]*historyEntry, error) {
+	entries, err := orm.GetSDHistory(userID)
+	if err != nil {
+		return nil, err
+	}
+	history := make([]*historyEntry, 0, len(entries))
+	for _, data := range entries {
+		entry := &historyEntry{}
+		if err = json.Unmarshal([]byte(data), entry); err != nil {
+			log.Error("unmarshal stable diffusion history failed", zap.Error(err))
+			continue
+		}
+		history = append(history, entry)
+	}
+	return history, nil
+}
+
+func findHistory(history []*historyEntry, arg string) *historyEntry {
+	if i := historyIndex(history, arg); i >= 0 {
+		return history[i]
+	}
+	return nil
+}
+
+// historyIndex returns index of entry whose job id is arg, -1 if it's not found.
+func historyIndex(history []*historyEntry, arg string) int {
+	id, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return -1
+	}
+	for i, entry := range history {
+		if entry.JobID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// renderHistory returns text and keyboard of the i-th entry of history, buttons are only for owner.
+func renderHistory(owner int64, history []*historyEntry, i int) (string, *ReplyMarkup) {
+	if i >= len(history) {
+		i = len(history) - 1
+	}
+	if i < 0 {
+		i = 0
+	}
+	entry := history[i]
+	req := &entry.Request
+
+	prompt := []rune(req.Prompt)
+	if len(prompt) > historyPromptLength {
+		prompt = append(prompt[:historyPromptLength], []rune("...")...)
+	}
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("#%d  %s  (%d/%d)\n\n", entry.JobID,
+		time.Unix(entry.CreatedAt, 0).In(util.TimeZoneCST).Format("2006-01-02 15:04"), i+1, len(history)))
+	sb.WriteString("prompt: " + string(prompt) + "\n")
+	sb.WriteString(fmt.Sprintf("seed: %d, sampler: %s, steps: %d, cfg: %d, size: %dx%d\n",
+		req.Seed, req.SamplerIndex, req.Steps, req.CfgScale, req.Width, req.Height))
+	if entry.Model != "" {
+		sb.WriteString("model: " + entry.Model + "\n")
+	}
+	if req.HiResEnabled {
+		sb.WriteString(fmt.Sprintf("高清修复: %gx %s\n", req.HiResScale, req.HiResUpscaler))
+	}
+	if entry.InitFileID != "" {
+		sb.WriteString("改图\n")
+	}
+	sb.WriteString(fmt.Sprintf("共 %d 张图", len(entry.FileIDs)))
+
+	markup := &ReplyMarkup{}
+	data := func(action string, arg int64) []string {
+		return []string{strconv.FormatInt(owner, 10), action, strconv.FormatInt(arg, 10)}
+	}
+	rows := []Row{markup.Row(
+		markup.Data("🖼 看图", HistoryButton.Unique, data(historyShow, entry.JobID)...),
+		markup.Data("🔄 重画", HistoryButton.Unique, data(historyRerun, entry.JobID)...),
+	)}
+	// pages are turned by job id, so that old keyboard still works after new entries are added
+	var nav []Btn
+	if i > 0 {
+		nav = append(nav, markup.Data("⬅️", HistoryButton.Unique, data(historyPage, history[i-1].JobID)...))
+	}
+	if i < len(history)-1 {
+		nav = append(nav, markup.Data("➡️", HistoryButton.Unique, data(historyPage, history[i+1].JobID)...))
+	}
+	if len(nav) > 0 {
+		rows = append(rows, markup.Row(nav...))
+	}
+	markup.Inline(rows...)
+	return sb.String(), markup
+}
+
+// HistoryHandler handle /sdhistory command, page through your finished generations, `/sdhistory <n>` starts at the n-th.
+func HistoryHandler(ctx Context) error {
+	userID := ctx.Sender().ID
+	history, err := loadHistory(userID)
+	if err != nil {
+		return ctx.Reply("完了，删库跑路了")
+	}
+	if len(history) == 0 {
+		return ctx.Reply("你还没有画过图，快用 /sd 画一张吧")
+	}
+
+	i := 0
+	command := entities.FromMessage(ctx.Message())
+	if n, err := strconv.Atoi(command.Arg(0)); err == nil {
+		i = n - 1
+	}
+	text, markup := renderHistory(userID, history, i)
+	return ctx.Reply(text, markup)
+}
+
+// HistoryCallback handle buttons of history, `<owner>|page|<job id>` turns page to the entry,
+// `<owner>|show|<job id>` sends images and `<owner>|rerun|<job id>` reruns the entry with the same seed.
+func HistoryCallback(ctx Context) error {
+	args := strings.Split(ctx.Data(), "|")
+	if len(args) != 3 {
+		return ctx.Respond()
+	}
+	owner, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return ctx.Respond()
+	}
+	if owner != ctx.Sender().ID {
+		return ctx.Respond(&CallbackResponse{Text: "这不是你的历史记录，用 /sdhistory 看看自己的吧"})
+	}
+
+	history, err := loadHistory(owner)
+	if err != nil {
+		return ctx.Respond(&CallbackResponse{Text: "完了，删库跑路了"})
+	}
+	if len(history) == 0 {
+		return ctx.Respond(&CallbackResponse{Text: "历史记录已经过期了", ShowAlert: true})
+	}
+
+	switch args[1] {
+	case historyPage:
+		i := historyIndex(history, args[2])
+		if i < 0 {
+			return ctx.Respond(&CallbackResponse{Text: "这条记录已经找不到了"})
+		}
+		text, markup := renderHistory(owner, history, i)
+		if err = ctx.Edit(text, markup); err != nil {
+			log.Debug("edit stable diffusion history failed", zap.Error(err))
+		}
+		return ctx.Respond()
+	case historyShow:
+		entry := findHistory(history, args[2])
+		if entry == nil {
+			return ctx.Respond(&CallbackResponse{Text: "这条记录已经找不到了"})
+		}
+		return showHistory(ctx, entry)
+	case historyRerun:
+		entry := findHistory(history, args[2])
+		if entry == nil {
+			return ctx.Respond(&CallbackResponse{Text: "这条记录已经找不到了"})
+		}
+		return rerunHistory(ctx, entry)
+	}
+	return ctx.Respond()
+}
+
+// showHistory sends images of entry as a reply of history message.
+func showHistory(ctx Context, entry *historyEntry) error {
+	album := Album{}
+	for _, id := range entry.FileIDs {
+		if entry.Documents {
+			album = append(album, &Document{File: File{FileID: id}})
+		} else {
+			album = append(album, &Photo{File: File{FileID: id}})
+		}
+	}
+	if len(album) == 0 {
+		return ctx.Respond(&CallbackResponse{Text: "这条记录没有图"})
+	}
+	if _, err := ctx.Bot().SendAlbum(ctx.Chat(), album, &SendOptions{ReplyTo: ctx.Message(), AllowWithoutReply: true}); err != nil {
+		log.Error("send stable diffusion history images failed", zap.Error(err))
+		return ctx.Respond(&CallbackResponse{Text: "图片发不出来了"})
+	}
+	return ctx.Respond()
+}
+
+// rerunHistory submits request of entry as a new job with the same seed.
+func rerunHistory(ctx Context, entry *historyEntry) error {
+	config, err := getConfigByUserID(ctx.Sender().ID)
+	if err != nil {
+		return ctx.Respond(&CallbackResponse{Text: "完了，删库跑路了"})
+	}
+	if config.GetServer() == "" && !pool.available() {
+		return ctx.Respond(&CallbackResponse{Text: "你还没有配置服务器，快使用 /sdcfg 配置一个吧", ShowAlert: true})
+	}
+
+	job := &StableDiffusionContext{
+		UserConfig: *config,
+		Request:    entry.Request,
+		InitFileID: entry.InitFileID,
+	}
+	if err = submit(ctx, job); err != nil {
+		log.Error("submit stable diffusion job failed", zap.Error(err))
+	}
+	return ctx.Respond()
+}
@@ -0,0 +1,49 @@
+package sd
+
+import (
+	"csust-got/config"
+	"encoding/base64"
+	"io"
+	"strings"
+
+	. "gopkg.in/telebot.v3"
+)
+
+// maxInitImageSize is the max size of image used by img2img.
+const maxInitImageSize = 10 << 20
+
+// replyImage returns the photo (or image document) replied by msg, nil if msg doesn't reply to an image.
+func replyImage(msg *Message) *File {
+	replyTo := msg.ReplyTo
+	if replyTo == nil {
+		return nil
+	}
+	switch {
+	case replyTo.Photo != nil:
+		return &replyTo.Photo.File
+	case replyTo.Document != nil && strings.HasPrefix(replyTo.Document.MIME, "image/"):
+		return &replyTo.Document.File
+	}
+	return nil
+}
+
+// downloadImage downloads image of img2img, and returns it in base64.
+func downloadImage(file *File) (string, error) {
+	if file.FileSize > maxInitImageSize {
+		return "", ErrImageTooLarge
+	}
+
+	reader, err := config.BotConfig.Bot.File(file)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = reader.Close() }()
+	data, err := io.ReadAll(io.LimitReader(reader, maxInitImageSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxInitImageSize {
+		return "", ErrImageTooLarge
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
@@ -0,0 +1,74 @@
+package sd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngParametersKey is the keyword of text chunk, which WebUI reads in PNG Info tab.
+const pngParametersKey = "parameters"
+
+// withParameters returns png with generation parameters in a text chunk after IHDR,
+// existing parameters are replaced, and png is returned as is if it's not a valid png.
+func withParameters(png []byte, parameters string) []byte {
+	if !bytes.HasPrefix(png, pngSignature) || parameters == "" {
+		return png
+	}
+
+	ihdrEnd := 0
+	// old parameters chunks, which are dropped
+	var dropped [][2]int
+	for offset := len(pngSignature); offset < len(png); {
+		if offset+8 > len(png) {
+			return png
+		}
+		length := int(binary.BigEndian.Uint32(png[offset:]))
+		typ := string(png[offset+4 : offset+8])
+		end := offset + 12 + length
+		if length < 0 || end > len(png) {
+			return png
+		}
+		switch typ {
+		case "IHDR":
+			ihdrEnd = end
+		case "tEXt", "iTXt", "zTXt":
+			if ihdrEnd > 0 && bytes.HasPrefix(png[offset+8:end], []byte(pngParametersKey+"\x00")) {
+				dropped = append(dropped, [2]int{offset, end})
+			}
+		case "IEND":
+			end = len(png)
+		}
+		offset = end
+	}
+	if ihdrEnd == 0 {
+		return png
+	}
+
+	result := make([]byte, 0, len(png)+len(parameters)+32)
+	result = append(result, png[:ihdrEnd]...)
+	result = append(result, textChunk(parameters)...)
+	last := ihdrEnd
+	for _, r := range dropped {
+		result = append(result, png[last:r[0]]...)
+		last = r[1]
+	}
+	return append(result, png[last:]...)
+}
+
+// textChunk returns an uncompressed iTXt chunk of parameters, which is utf-8 encoded unlike tEXt.
+func textChunk(parameters string) []byte {
+	var data bytes.Buffer
+	data.WriteString("iTXt")
+	data.WriteString(pngParametersKey)
+	// null separator, compression flag, compression method, empty language tag and translated keyword
+	data.Write([]byte{0, 0, 0, 0, 0})
+	data.WriteString(parameters)
+
+	chunk := make([]byte, 4, data.Len()+8)
+	binary.BigEndian.PutUint32(chunk, uint32(data.Len()-4))
+	chunk = append(chunk, data.Bytes()...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(data.Bytes()))
+}
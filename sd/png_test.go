@@ -0,0 +1,99 @@
+package sd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type pngChunk struct {
+	typ  string
+	data string
+}
+
+func encodeChunk(c pngChunk) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(c.data)))
+	chunk = append(chunk, c.typ...)
+	chunk = append(chunk, c.data...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+// decodeChunks splits png into chunks, and checks crc of each chunk.
+func decodeChunks(t *testing.T, data []byte) []pngChunk {
+	require.True(t, bytes.HasPrefix(data, pngSignature))
+	var chunks []pngChunk
+	for offset := len(pngSignature); offset < len(data); {
+		length := int(binary.BigEndian.Uint32(data[offset:]))
+		end := offset + 12 + length
+		require.LessOrEqual(t, end, len(data))
+		require.Equal(t, crc32.ChecksumIEEE(data[offset+4:end-4]), binary.BigEndian.Uint32(data[end-4:]))
+		chunks = append(chunks, pngChunk{typ: string(data[offset+4 : offset+8]), data: string(data[offset+8 : end-4])})
+		offset = end
+	}
+	return chunks
+}
+
+// withChunk inserts chunk before IEND of png.
+func withChunk(data []byte, c pngChunk) []byte {
+	iend := len(data) - 12
+	result := append([]byte{}, data[:iend]...)
+	result = append(result, encodeChunk(c)...)
+	return append(result, data[iend:]...)
+}
+
+func Test_withParameters(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))))
+	plain := buf.Bytes()
+
+	parameters := pngChunk{typ: "iTXt", data: "parameters\x00\x00\x00\x00\x00masterpiece\nSteps: 20, Seed: 1"}
+	software := pngChunk{typ: "tEXt", data: "Software\x00test"}
+
+	tests := []struct {
+		name  string
+		png   []byte
+		text  string
+		types []string
+		extra *pngChunk
+	}{
+		{name: "insert after IHDR", png: plain, text: "masterpiece\nSteps: 20, Seed: 1",
+			types: []string{"IHDR", "iTXt", "IDAT", "IEND"}},
+		{name: "replace tEXt parameters", png: withChunk(plain, pngChunk{typ: "tEXt", data: "parameters\x00old"}),
+			text: "masterpiece\nSteps: 20, Seed: 1", types: []string{"IHDR", "iTXt", "IDAT", "IEND"}},
+		{name: "replace iTXt parameters", png: withChunk(plain, pngChunk{typ: "iTXt", data: "parameters\x00\x00\x00\x00\x00old"}),
+			text: "masterpiece\nSteps: 20, Seed: 1", types: []string{"IHDR", "iTXt", "IDAT", "IEND"}},
+		{name: "keep other text", png: withChunk(plain, software), text: "masterpiece\nSteps: 20, Seed: 1",
+			types: []string{"IHDR", "iTXt", "IDAT", "tEXt", "IEND"}, extra: &software},
+		{name: "not png", png: []byte("not a png"), text: "masterpiece"},
+		{name: "truncated", png: plain[:len(plain)-6], text: "masterpiece"},
+		{name: "truncated header", png: plain[:len(pngSignature)+4], text: "masterpiece"},
+		{name: "empty parameters", png: plain, text: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := withParameters(tt.png, tt.text)
+			if tt.types == nil {
+				require.Equal(t, tt.png, got)
+				return
+			}
+
+			chunks := decodeChunks(t, got)
+			types := make([]string, 0, len(chunks))
+			for _, c := range chunks {
+				types = append(types, c.typ)
+			}
+			require.Equal(t, tt.types, types)
+			require.Equal(t, parameters, chunks[1])
+			if tt.extra != nil {
+				require.Contains(t, chunks, *tt.extra)
+			}
+			_, err := png.Decode(bytes.NewReader(got))
+			require.NoError(t, err)
+		})
+	}
+}
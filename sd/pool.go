@@ -0,0 +1,376 @@
+package sd
+
+import (
+	"context"
+	"csust-got/config"
+	"csust-got/log"
+	"csust-got/orm"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// sdServer is a stable diffusion backend, it runs one job at a time.
+type sdServer struct {
+	addr   string
+	weight int
+	pooled bool // servers not in pool are user's own server or default server, which are not health checked
+
+	// fields below are protected by serverPool.mu
+	busy      int  // running jobs, jobs are only dispatched to server when it's idle
+	removed   bool // removed from pool but still has jobs, it's deleted once jobs are finished
+	healthy   bool
+	checkedAt time.Time
+	latency   time.Duration
+	lastErr   string
+	finished  int
+	failed    int
+}
+
+func newSDServer(addr string, weight int, pooled bool) *sdServer {
+	return &sdServer{addr: addr, weight: weight, pooled: pooled, healthy: true}
+}
+
+// run requests stable diffusion on server, server has been reserved for the job by scheduler.
+func (s *sdServer) run(ctx context.Context, req *StableDiffusionReq, r *progressReporter) (*StableDiffusionResp, error) {
+	watchCtx, cancel := context.WithCancel(ctx)
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		r.watch(watchCtx, s.addr)
+	}()
+	defer func() {
+		cancel()
+		<-watched
+	}()
+	resp, err := requestStableDiffusion(ctx, s.addr, req)
+	if ctx.Err() != nil {
+		// WebUI keeps drawing after request is canceled, interrupt it
+		interruptServer(s.addr)
+	}
+	return resp, err
+}
+
+// serverPool is the admin-managed stable diffusion servers, stored in redis.
+type serverPool struct {
+	mu      sync.Mutex
+	servers map[string]*sdServer
+	others  map[string]*sdServer
+}
+
+var pool = newServerPool()
+
+func newServerPool() *serverPool {
+	return &serverPool{
+		servers: make(map[string]*sdServer),
+		others:  make(map[string]*sdServer),
+	}
+}
+
+// load syncs servers from redis, new servers are healthy until checked.
+func (p *serverPool) load() error {
+	servers, err := orm.GetSDServers()
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	// jobs may wait for new servers, wake them after unlock
+	defer sched.wake()
+	defer p.mu.Unlock()
+	for addr, s := range p.servers {
+		if _, ok := servers[addr]; ok {
+			continue
+		}
+		// removed server can't be picked, but its jobs are kept running
+		s.removed = true
+		if s.busy == 0 {
+			delete(p.servers, addr)
+		}
+	}
+	for addr, weight := range servers {
+		s, ok := p.servers[addr]
+		if !ok {
+			s = newSDServer(addr, weight, true)
+			p.servers[addr] = s
+		}
+		s.weight = weight
+		s.removed = false
+	}
+	return nil
+}
+
+// server returns the server of addr in pool, nil if it's not in pool.
+func (p *serverPool) server(addr string) *sdServer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.servers[addr]
+	if !ok || s.removed {
+		return nil
+	}
+	return s
+}
+
+// available reports whether there is any server in pool.
+func (p *serverPool) available() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, s := range p.servers {
+		if !s.removed {
+			return true
+		}
+	}
+	return false
+}
+
+// reserve reserves an idle server for job, it returns nil server and nil error if job has to wait for a server.
+// Job runs on server of user's config if it's set, otherwise on servers in pool, servers tried by job are skipped.
+func (p *serverPool) reserve(job *StableDiffusionContext) (*sdServer, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if job.UserConfig.Server != "" {
+		return p.acquireLocked(job.UserConfig.Server), nil
+	}
+
+	var best *sdServer
+	waiting, available := false, false
+	for _, s := range p.servers {
+		if s.removed {
+			continue
+		}
+		available = true
+		if !s.healthy || job.tried[s.addr] {
+			continue
+		}
+		if s.busy > 0 {
+			waiting = true
+			continue
+		}
+		if best == nil || s.weight > best.weight || (s.weight == best.weight && s.addr < best.addr) {
+			best = s
+		}
+	}
+	switch {
+	case best != nil:
+		best.busy++
+		return best, nil
+	case waiting:
+		return nil, nil
+	case !available:
+		// no server in pool, fallback to default server
+		return p.acquireLocked(orm.GetSDDefaultServer()), nil
+	case len(job.tried) > 0:
+		return nil, fmt.Errorf("%w: all servers failed", ErrNoServerAvailable)
+	}
+	return nil, ErrNoServerAvailable
+}
+
+// healthyServers returns addresses of healthy servers in pool.
+func (p *serverPool) healthyServers() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var addrs []string
+	for _, s := range p.servers {
+		if s.healthy && !s.removed {
+			addrs = append(addrs, s.addr)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// acquireLocked returns the server of addr if it's idle, which is used by user's config or as default server.
+func (p *serverPool) acquireLocked(addr string) *sdServer {
+	s, ok := p.servers[addr]
+	if !ok {
+		s, ok = p.others[addr]
+		if !ok {
+			s = newSDServer(addr, 1, false)
+			p.others[addr] = s
+		}
+	}
+	if s.busy > 0 {
+		return nil
+	}
+	s.busy++
+	return s
+}
+
+// release marks job on s finished, pooled server is marked unhealthy if it is not available.
+func (p *serverPool) release(s *sdServer, err error) {
+	p.mu.Lock()
+	// jobs may wait for the server, wake them after unlock
+	defer sched.wake()
+	defer p.mu.Unlock()
+	p.freeLocked(s)
+	if err == nil {
+		s.finished++
+		return
+	}
+	s.failed++
+	if s.pooled && errors.Is(err, ErrServerNotAvailable) {
+		s.healthy = false
+		s.lastErr = err.Error()
+	}
+}
+
+// free releases s which is reserved for a job, but the job doesn't run on it.
+func (p *serverPool) free(s *sdServer) {
+	p.mu.Lock()
+	defer sched.wake()
+	defer p.mu.Unlock()
+	p.freeLocked(s)
+}
+
+func (p *serverPool) freeLocked(s *sdServer) {
+	s.busy--
+	if !s.pooled && s.busy == 0 {
+		delete(p.others, s.addr)
+	}
+	if s.removed && s.busy == 0 && p.servers[s.addr] == s {
+		delete(p.servers, s.addr)
+	}
+}
+
+func runOn(ctx context.Context, s *sdServer, req *StableDiffusionReq, r *progressReporter) (*StableDiffusionResp, error) {
+	resp, err := s.run(ctx, req, r)
+	pool.release(s, err)
+	return resp, err
+}
+
+// healthCheck loads servers from redis and probes them periodically.
+func (p *serverPool) healthCheck() {
+	interval := time.Duration(config.BotConfig.SDConfig.HealthCheckInterval) * time.Second
+	for {
+		if err := p.load(); err == nil {
+			p.probeAll()
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (p *serverPool) probeAll() {
+	p.mu.Lock()
+	servers := make([]*sdServer, 0, len(p.servers))
+	for _, s := range p.servers {
+		if !s.removed {
+			servers = append(servers, s)
+		}
+	}
+	p.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *sdServer) {
+			defer wg.Done()
+			_ = p.probe(s)
+		}(s)
+	}
+	wg.Wait()
+}
+
+// probe checks whether server is alive by the progress api of WebUI, and saves the result.
+func (p *serverPool) probe(s *sdServer) error {
+	start := time.Now()
+	err := probeServer(s.addr)
+	latency := time.Since(start)
+
+	p.mu.Lock()
+	// jobs waiting for servers may be dispatched or failed, wake them after unlock
+	defer sched.wake()
+	defer p.mu.Unlock()
+	if !s.healthy && err == nil {
+		log.Info("stable diffusion server is back", zap.String("server", s.addr))
+	}
+	if s.healthy && err != nil {
+		log.Warn("stable diffusion server is down", zap.String("server", s.addr), zap.Error(err))
+	}
+	s.healthy = err == nil
+	s.checkedAt = start
+	s.latency = latency
+	if err != nil {
+		s.lastErr = err.Error()
+	}
+	return err
+}
+
+func probeServer(addr string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, addr+"/sdapi/v1/progress?skip_current_image=true", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrServerNotAvailable, err.Error())
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: status code %d", ErrServerNotAvailable, resp.StatusCode)
+	}
+	return nil
+}
+
+// interruptServer stops the running job of server.
+func interruptServer(addr string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, addr+"/sdapi/v1/interrupt", nil)
+	if err != nil {
+		return
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		log.Error("interrupt stable diffusion server failed", zap.String("server", addr), zap.Error(err))
+		return
+	}
+	_ = resp.Body.Close()
+}
+
+// status returns the status of servers in pool, address is hidden if showAddr is false.
+func (p *serverPool) status(showAddr bool) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	servers := make([]*sdServer, 0, len(p.servers))
+	for _, s := range p.servers {
+		if !s.removed {
+			servers = append(servers, s)
+		}
+	}
+	if len(servers) == 0 {
+		return "服务器池是空的"
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].addr < servers[j].addr })
+
+	var sb strings.Builder
+	for i, s := range servers {
+		name := fmt.Sprintf("#%d", i+1)
+		if showAddr {
+			name += " " + s.addr
+		}
+		state := "🟢"
+		if !s.healthy {
+			state = "🔴"
+		}
+		work := "空闲"
+		if s.busy > 0 {
+			work = "在画"
+		}
+		sb.WriteString(fmt.Sprintf("%s %s 权重 %d，%s，完成 %d，失败 %d", state, name, s.weight, work, s.finished, s.failed))
+		if !s.checkedAt.IsZero() {
+			sb.WriteString(fmt.Sprintf("，延迟 %dms", s.latency.Milliseconds()))
+		}
+		if !s.healthy && showAddr && s.lastErr != "" {
+			sb.WriteString("\n    " + s.lastErr)
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
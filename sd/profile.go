@@ -0,0 +1,193 @@
+package sd
+
+import (
+	"crypto/rand"
+	"csust-got/entities"
+	"csust-got/orm"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	. "gopkg.in/telebot.v3"
+)
+
+// shareRetention is how long a share code can be imported.
+const shareRetention = 7 * 24 * time.Hour
+
+var profileNamePattern = regexp.MustCompile(`^[\w-]{1,32}$`)
+
+const profileHelpInfo = "sdcfg profile save \\<name\\>\n" +
+	"sdcfg profile load \\<name\\>\n" +
+	"sdcfg profile list\n" +
+	"sdcfg profile rm \\<name\\>\n" +
+	"sdcfg share \\[name\\]\n" +
+	"sdcfg import \\<code\\> \\[name\\]\n" +
+	"profile is a saved config, use `/sd @name prompt` to draw with it once without switching\\. " +
+	"server is not shared\\."
+
+// sharedProfile is a profile shared by code.
+type sharedProfile struct {
+	Name   string                `json:"name"`
+	Config StableDiffusionConfig `json:"config"`
+}
+
+func saveConfig(userID int64, config *StableDiffusionConfig) error {
+	configStr, err := json.MarshalIndent(config, "", "")
+	if err != nil {
+		return err
+	}
+	return orm.SetSDConfig(userID, string(configStr))
+}
+
+func getProfile(userID int64, name string) (*StableDiffusionConfig, error) {
+	data, err := orm.GetSDProfile(userID, name)
+	if err != nil {
+		return nil, err
+	}
+	config := &StableDiffusionConfig{}
+	if err = json.Unmarshal([]byte(data), config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func saveProfile(userID int64, name string, config *StableDiffusionConfig) error {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	return orm.SetSDProfile(userID, name, string(data))
+}
+
+// profileConfig returns config of profile for one run, current server is used if profile has no server.
+func profileConfig(userID int64, name string, current *StableDiffusionConfig) (*StableDiffusionConfig, error) {
+	config, err := getProfile(userID, name)
+	if err != nil {
+		return nil, err
+	}
+	if config.Server == "" {
+		config.Server = current.Server
+	}
+	return config, nil
+}
+
+// profileHandler handle `/sdcfg profile`.
+func profileHandler(ctx Context, command *entities.BotCommand, config *StableDiffusionConfig) error {
+	userID := ctx.Sender().ID
+	if command.Arg(1) == "list" {
+		profiles, err := orm.GetSDProfiles(userID)
+		if err != nil {
+			return ctx.Reply("完了，删库跑路了")
+		}
+		if len(profiles) == 0 {
+			return ctx.Reply("还没有保存过配置哦，用 /sdcfg profile save <name> 保存当前配置")
+		}
+		sort.Strings(profiles)
+		return ctx.Reply("你的配置: " + strings.Join(profiles, ", "))
+	}
+
+	name := command.Arg(2)
+	if command.Argc() < 3 {
+		return ctx.Reply(profileHelpInfo, ModeMarkdownV2)
+	}
+	switch command.Arg(1) {
+	case "save":
+		if !profileNamePattern.MatchString(name) {
+			return ctx.Reply("配置名只能包含字母、数字、下划线和减号，最长 32 个字符")
+		}
+		if err := saveProfile(userID, name, config); err != nil {
+			return ctx.Reply("完了，删库跑路了")
+		}
+		return ctx.Reply(fmt.Sprintf("配置 %s 保存成功，可以用 /sd @%s 使用它", name, name))
+	case "load":
+		profile, err := profileConfig(userID, name, config)
+		if errors.Is(err, redis.Nil) {
+			return ctx.Reply(fmt.Sprintf("没有配置 %s", name))
+		}
+		if err != nil {
+			return ctx.Reply("完了，删库跑路了")
+		}
+		if err = saveConfig(userID, profile); err != nil {
+			return ctx.Reply("完了，删库跑路了")
+		}
+		return ctx.Reply(fmt.Sprintf("已切换到配置 %s", name))
+	case "rm":
+		ok, err := orm.DelSDProfile(userID, name)
+		if err != nil {
+			return ctx.Reply("完了，删库跑路了")
+		}
+		if !ok {
+			return ctx.Reply(fmt.Sprintf("没有配置 %s", name))
+		}
+		return ctx.Reply(fmt.Sprintf("配置 %s 已删除", name))
+	}
+	return ctx.Reply(profileHelpInfo, ModeMarkdownV2)
+}
+
+// shareHandler handle `/sdcfg share [name]`, current config is shared if name is empty.
+func shareHandler(ctx Context, command *entities.BotCommand, config *StableDiffusionConfig) error {
+	name := command.Arg(1)
+	shared := sharedProfile{Name: name, Config: *config}
+	if name != "" {
+		profile, err := getProfile(ctx.Sender().ID, name)
+		if errors.Is(err, redis.Nil) {
+			return ctx.Reply(fmt.Sprintf("没有配置 %s", name))
+		}
+		if err != nil {
+			return ctx.Reply("完了，删库跑路了")
+		}
+		shared.Config = *profile
+	}
+	// server is secret
+	shared.Config.Server = ""
+
+	data, err := json.Marshal(shared)
+	if err != nil {
+		return ctx.Reply("感觉有点问题")
+	}
+	b := make([]byte, 4)
+	if _, err = rand.Read(b); err != nil {
+		return ctx.Reply("感觉有点问题")
+	}
+	code := hex.EncodeToString(b)
+	if err = orm.SetSDSharedProfile(code, string(data), shareRetention); err != nil {
+		return ctx.Reply("完了，删库跑路了")
+	}
+	return ctx.Reply(fmt.Sprintf("分享码: `%s`\n其他人可以用 `/sdcfg import %s` 导入，7 天内有效", code, code), ModeMarkdownV2)
+}
+
+// importHandler handle `/sdcfg import <code> [name]`, shared config is saved as profile.
+func importHandler(ctx Context, command *entities.BotCommand) error {
+	if command.Argc() < 2 {
+		return ctx.Reply(profileHelpInfo, ModeMarkdownV2)
+	}
+	data, err := orm.GetSDSharedProfile(command.Arg(1))
+	if errors.Is(err, redis.Nil) {
+		return ctx.Reply("分享码不存在或者已经过期了")
+	}
+	if err != nil {
+		return ctx.Reply("完了，删库跑路了")
+	}
+	var shared sharedProfile
+	if err = json.Unmarshal([]byte(data), &shared); err != nil {
+		return ctx.Reply("感觉有点问题")
+	}
+
+	name := command.Arg(2)
+	if name == "" {
+		name = shared.Name
+	}
+	if !profileNamePattern.MatchString(name) {
+		return ctx.Reply("请给导入的配置起个名字，只能包含字母、数字、下划线和减号，最长 32 个字符")
+	}
+	if err = saveProfile(ctx.Sender().ID, name, &shared.Config); err != nil {
+		return ctx.Reply("完了，删库跑路了")
+	}
+	return ctx.Reply(fmt.Sprintf("已导入为配置 %s，可以用 /sd @%s 使用它", name, name))
+}
@@ -0,0 +1,150 @@
+package sd
+
+import (
+	"bytes"
+	"context"
+	"csust-got/config"
+	"csust-got/log"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+	. "gopkg.in/telebot.v3"
+)
+
+const (
+	progressInterval = 3 * time.Second
+	previewInterval  = 10 * time.Second
+)
+
+// progressResp is the response of `/sdapi/v1/progress`.
+type progressResp struct {
+	Progress     float64 `json:"progress"`
+	EtaRelative  float64 `json:"eta_relative"`
+	CurrentImage string  `json:"current_image"`
+}
+
+func requestProgress(ctx context.Context, addr string, withImage bool) (*progressResp, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	url := fmt.Sprintf("%s/sdapi/v1/progress?skip_current_image=%t", addr, !withImage)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrServerNotAvailable, err.Error())
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: status code %d", ErrRequestNotOK, resp.StatusCode)
+	}
+	var progress progressResp
+	if err = json.NewDecoder(resp.Body).Decode(&progress); err != nil {
+		return nil, err
+	}
+	return &progress, nil
+}
+
+// progressReporter shows status of job by editing the status message,
+// the message is replaced by a photo message once a preview is shown.
+type progressReporter struct {
+	job       *StableDiffusionContext
+	status    *Message
+	isPhoto   bool
+	text      string
+	previewAt time.Time
+}
+
+func newProgressReporter(job *StableDiffusionContext) *progressReporter {
+	status := job.statusMsg()
+	if status == nil {
+		return nil
+	}
+	return &progressReporter{job: job, status: status}
+}
+
+// watch polls progress of server until ctx is done.
+func (r *progressReporter) watch(ctx context.Context, addr string) {
+	if r == nil {
+		return
+	}
+	preview := r.job.UserConfig.GetValueByKey("preview").(string) == "on"
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		withImage := preview && time.Since(r.previewAt) >= previewInterval
+		progress, err := requestProgress(ctx, addr, withImage)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Debug("request stable diffusion progress failed", zap.Error(err))
+			}
+			continue
+		}
+
+		text := fmt.Sprintf("在画了在画了 %.0f%%", progress.Progress*100)
+		if progress.EtaRelative > 0 {
+			text += fmt.Sprintf("，预计还要 %.0f 秒", progress.EtaRelative)
+		}
+		var image []byte
+		if withImage && progress.CurrentImage != "" {
+			image, err = base64.StdEncoding.DecodeString(progress.CurrentImage)
+			if err != nil {
+				log.Error("decode stable diffusion preview failed", zap.Error(err))
+			} else {
+				r.previewAt = time.Now()
+			}
+		}
+		r.edit(text, image)
+	}
+}
+
+// edit updates status message, the message is not edited if nothing changes.
+func (r *progressReporter) edit(text string, image []byte) {
+	if text == r.text && image == nil {
+		return
+	}
+	r.text = text
+
+	bot := config.BotConfig.Bot
+	var err error
+	switch {
+	case image != nil && r.isPhoto:
+		_, err = bot.Edit(r.status, &Photo{File: FromReader(bytes.NewReader(image)), Caption: text})
+	case image != nil:
+		var msg *Message
+		msg, err = r.job.reply(&Photo{File: FromReader(bytes.NewReader(image)), Caption: text})
+		if err == nil {
+			_ = bot.Delete(r.status)
+			r.status, r.isPhoto = msg, true
+			sched.setStatus(r.job, msg.ID)
+		}
+	case r.isPhoto:
+		_, err = bot.EditCaption(r.status, text)
+	default:
+		_, err = bot.Edit(r.status, text)
+	}
+	if err != nil {
+		log.Debug("edit stable diffusion status failed", zap.Error(err))
+	}
+}
+
+// finish deletes status message, since result is sent as a new message.
+func (r *progressReporter) finish() {
+	if r == nil {
+		return
+	}
+	if err := config.BotConfig.Bot.Delete(r.status); err != nil {
+		log.Debug("delete stable diffusion status failed", zap.Error(err))
+	}
+}
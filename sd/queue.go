@@ -0,0 +1,399 @@
+package sd
+
+import (
+	"context"
+	"csust-got/config"
+	"csust-got/entities"
+	"csust-got/log"
+	"csust-got/orm"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	. "gopkg.in/telebot.v3"
+)
+
+const (
+	// maxUserJobs is the max pending and running jobs of a user.
+	maxUserJobs = 3
+	// maxPendingJobs is the max pending jobs of all users.
+	maxPendingJobs = 20
+	// jobRetention is how long a finished job is kept.
+	jobRetention = 24 * time.Hour
+)
+
+// scheduler dispatches pending jobs round-robin across users, so that one user can't block others.
+// A job is dispatched only when there is an idle server for it, so jobs don't wait anywhere else.
+// Jobs are saved in redis, and unfinished jobs are resumed after restart.
+type scheduler struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending map[int64][]*StableDiffusionContext // user -> pending jobs in order
+	users   []int64                             // users who have pending jobs, in round-robin order
+	running map[int64]*StableDiffusionContext   // job id -> running job
+	active  map[int64]int                       // user -> count of pending and running jobs
+}
+
+var sched = newScheduler()
+
+func newScheduler() *scheduler {
+	s := &scheduler{
+		pending: make(map[int64][]*StableDiffusionContext),
+		running: make(map[int64]*StableDiffusionContext),
+		active:  make(map[int64]int),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func saveJob(job *StableDiffusionContext) {
+	data, err := json.Marshal(job)
+	if err != nil {
+		log.Error("marshal stable diffusion job failed", zap.Int64("job", job.ID), zap.Error(err))
+		return
+	}
+	if job.State == jobPending || job.State == jobRunning {
+		_ = orm.SetSDJob(job.ID, string(data), 0)
+		_ = orm.AddSDJobID(job.ID)
+		return
+	}
+	_ = orm.SetSDJob(job.ID, string(data), jobRetention)
+	_ = orm.DelSDJobID(job.ID)
+}
+
+// check returns error if user can't submit more jobs.
+func (s *scheduler) check(userID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.checkLocked(userID)
+}
+
+func (s *scheduler) checkLocked(userID int64) error {
+	if s.active[userID] >= maxUserJobs {
+		return ErrTooManyJobs
+	}
+	if s.pendingCount() >= maxPendingJobs {
+		return ErrQueueFull
+	}
+	return nil
+}
+
+func (s *scheduler) pendingCount() int {
+	n := 0
+	for _, jobs := range s.pending {
+		n += len(jobs)
+	}
+	return n
+}
+
+// push adds a new job to queue, job is assigned an id and saved.
+func (s *scheduler) push(job *StableDiffusionContext) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkLocked(job.UserID); err != nil {
+		return err
+	}
+	id, err := orm.NewSDJobID()
+	if err != nil {
+		return err
+	}
+	job.ID = id
+	job.State = jobPending
+	job.CreatedAt = time.Now().Unix()
+	saveJob(job)
+	s.enqueueLocked(job)
+	return nil
+}
+
+func (s *scheduler) enqueueLocked(job *StableDiffusionContext) {
+	job.ctx, job.cancel = context.WithCancel(context.Background())
+	if len(s.pending[job.UserID]) == 0 {
+		s.users = append(s.users, job.UserID)
+	}
+	s.pending[job.UserID] = append(s.pending[job.UserID], job)
+	s.active[job.UserID]++
+	s.cond.Signal()
+}
+
+// pop waits for a pending job which can run, the first jobs of users are checked in round-robin order,
+// and the first one which has an idle server is returned with the server reserved and marked running.
+// err is not nil if job can't run on any server.
+func (s *scheduler) pop() (*StableDiffusionContext, *sdServer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		for i, userID := range s.users {
+			jobs := s.pending[userID]
+			job := jobs[0]
+			server, err := pool.reserve(job)
+			if server == nil && err == nil {
+				// users waiting for servers keep their turns
+				continue
+			}
+
+			s.users = append(s.users[:i:i], s.users[i+1:]...)
+			if len(jobs) > 1 {
+				s.pending[userID] = jobs[1:]
+				s.users = append(s.users, userID)
+			} else {
+				delete(s.pending, userID)
+			}
+			job.State = jobRunning
+			s.running[job.ID] = job
+			saveJob(job)
+			return job, server, err
+		}
+		s.cond.Wait()
+	}
+}
+
+// wake makes pop check pending jobs again, it's called when servers may become idle.
+func (s *scheduler) wake() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cond.Signal()
+}
+
+// retry moves running job back to the front of queue, addr is not available for job,
+// job is run on other servers in pool. It's ignored if job is canceled.
+func (s *scheduler) retry(job *StableDiffusionContext, addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.running[job.ID]; !ok {
+		return
+	}
+	delete(s.running, job.ID)
+	if job.tried == nil {
+		job.tried = make(map[string]bool)
+	}
+	job.tried[addr] = true
+	job.State = jobPending
+	saveJob(job)
+
+	if len(s.pending[job.UserID]) > 0 {
+		for i, u := range s.users {
+			if u == job.UserID {
+				s.users = append(s.users[:i:i], s.users[i+1:]...)
+				break
+			}
+		}
+	}
+	s.pending[job.UserID] = append([]*StableDiffusionContext{job}, s.pending[job.UserID]...)
+	s.users = append([]int64{job.UserID}, s.users...)
+	s.cond.Signal()
+}
+
+// finish marks running job finished with state, it's ignored if job is canceled.
+func (s *scheduler) finish(job *StableDiffusionContext, state jobState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.running[job.ID]; !ok {
+		return
+	}
+	delete(s.running, job.ID)
+	s.active[job.UserID]--
+	if s.active[job.UserID] <= 0 {
+		delete(s.active, job.UserID)
+	}
+	job.cancel()
+	job.State = state
+	saveJob(job)
+}
+
+// cancel cancels pending or running job of user, returns false if there is no such job.
+func (s *scheduler) cancel(userID, jobID int64) bool {
+	status, ok := s.remove(userID, jobID)
+	if !ok {
+		return false
+	}
+	if status != nil {
+		// status message is a photo if preview is shown
+		if _, err := config.BotConfig.Bot.Edit(status, "已取消"); err != nil {
+			_, _ = config.BotConfig.Bot.EditCaption(status, "已取消")
+		}
+	}
+	return true
+}
+
+// remove removes pending or running job of user and marks it canceled, returns status message of job.
+func (s *scheduler) remove(userID, jobID int64) (*Message, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if job, ok := s.running[jobID]; ok && job.UserID == userID {
+		delete(s.running, jobID)
+		s.cancelLocked(job)
+		return job.statusMsg(), true
+	}
+
+	jobs := s.pending[userID]
+	for i, job := range jobs {
+		if job.ID != jobID {
+			continue
+		}
+		s.pending[userID] = append(jobs[:i:i], jobs[i+1:]...)
+		if len(s.pending[userID]) == 0 {
+			delete(s.pending, userID)
+			for j, u := range s.users {
+				if u == userID {
+					s.users = append(s.users[:j:j], s.users[j+1:]...)
+					break
+				}
+			}
+		}
+		s.cancelLocked(job)
+		return job.statusMsg(), true
+	}
+	return nil, false
+}
+
+// setStatus changes status message of job.
+func (s *scheduler) setStatus(job *StableDiffusionContext, msgID int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job.StatusMsgID = msgID
+}
+
+// update saves running job which is changed, it's ignored if job is canceled.
+func (s *scheduler) update(job *StableDiffusionContext) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.running[job.ID]; ok {
+		saveJob(job)
+	}
+}
+
+func (s *scheduler) cancelLocked(job *StableDiffusionContext) {
+	s.active[job.UserID]--
+	if s.active[job.UserID] <= 0 {
+		delete(s.active, job.UserID)
+	}
+	job.cancel()
+	job.State = jobCanceled
+	saveJob(job)
+}
+
+// order returns pending jobs in the order they will be run.
+func (s *scheduler) order() []*StableDiffusionContext {
+	var jobs []*StableDiffusionContext
+	for round := 0; ; round++ {
+		added := false
+		for _, userID := range s.users {
+			if round < len(s.pending[userID]) {
+				jobs = append(jobs, s.pending[userID][round])
+				added = true
+			}
+		}
+		if !added {
+			return jobs
+		}
+	}
+}
+
+// restore loads unfinished jobs from redis, running jobs are run again.
+func (s *scheduler) restore() {
+	ids, err := orm.GetSDJobIDs()
+	if err != nil {
+		return
+	}
+
+	var jobs []*StableDiffusionContext
+	for _, id := range ids {
+		data, err := orm.GetSDJob(id)
+		if err != nil {
+			_ = orm.DelSDJobID(id)
+			continue
+		}
+		job := &StableDiffusionContext{}
+		if err = json.Unmarshal([]byte(data), job); err != nil {
+			log.Error("unmarshal stable diffusion job failed", zap.Int64("job", id), zap.Error(err))
+			_ = orm.DelSDJobID(id)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, job := range jobs {
+		job.State = jobPending
+		s.enqueueLocked(job)
+	}
+	if len(jobs) > 0 {
+		log.Info("stable diffusion jobs restored", zap.Int("count", len(jobs)))
+	}
+}
+
+// QueueHandler handle /sdqueue command, show your jobs, or cancel them by `/sdqueue cancel [id]`.
+func QueueHandler(ctx Context) error {
+	userID := ctx.Sender().ID
+	command := entities.FromMessage(ctx.Message())
+	if command.Argc() > 0 && command.Arg(0) == "cancel" {
+		return cancelJobs(ctx, command.Arg(1))
+	}
+
+	sched.mu.Lock()
+	var running []int64
+	for id, job := range sched.running {
+		if job.UserID == userID {
+			running = append(running, id)
+		}
+	}
+	order := sched.order()
+	sched.mu.Unlock()
+	sort.Slice(running, func(i, j int) bool { return running[i] < running[j] })
+
+	var sb strings.Builder
+	for _, id := range running {
+		sb.WriteString(fmt.Sprintf("#%d 正在画\n", id))
+	}
+	for i, job := range order {
+		if job.UserID == userID {
+			sb.WriteString(fmt.Sprintf("#%d 排队中，前面还有 %d 个任务\n", job.ID, i))
+		}
+	}
+	if sb.Len() == 0 {
+		return ctx.Reply(fmt.Sprintf("你没有正在画的图，队列里一共有 %d 个任务", len(order)))
+	}
+	sb.WriteString("\n用 /sdqueue cancel [id] 取消任务")
+	return ctx.Reply(sb.String())
+}
+
+func cancelJobs(ctx Context, arg string) error {
+	userID := ctx.Sender().ID
+	if arg != "" {
+		id, err := strconv.ParseInt(strings.TrimPrefix(arg, "#"), 10, 64)
+		if err != nil || !sched.cancel(userID, id) {
+			return ctx.Reply("没有找到你的这个任务")
+		}
+		return ctx.Reply(fmt.Sprintf("任务 #%d 已取消", id))
+	}
+
+	sched.mu.Lock()
+	var ids []int64
+	for id, job := range sched.running {
+		if job.UserID == userID {
+			ids = append(ids, id)
+		}
+	}
+	for _, job := range sched.pending[userID] {
+		ids = append(ids, job.ID)
+	}
+	sched.mu.Unlock()
+
+	n := 0
+	for _, id := range ids {
+		if sched.cancel(userID, id) {
+			n++
+		}
+	}
+	if n == 0 {
+		return ctx.Reply("你没有可以取消的任务")
+	}
+	return ctx.Reply(fmt.Sprintf("已取消 %d 个任务", n))
+}
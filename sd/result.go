@@ -0,0 +1,205 @@
+package sd
+
+import (
+	"csust-got/entities"
+	"csust-got/log"
+	"csust-got/orm"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	. "gopkg.in/telebot.v3"
+)
+
+// resultRetention is how long the result of a message can be rerun.
+const resultRetention = 7 * 24 * time.Hour
+
+// generationInfo is info of generated images returned by WebUI.
+type generationInfo struct {
+	Seed            int64   `json:"seed"`
+	AllSeeds        []int64 `json:"all_seeds"`
+	Subseed         int64   `json:"subseed"`
+	AllSubseeds     []int64 `json:"all_subseeds"`
+	SubseedStrength float64 `json:"subseed_strength"`
+	Sampler         string  `json:"sampler_name"`
+	Steps           int     `json:"steps"`
+	CfgScale        float64 `json:"cfg_scale"`
+	Width           int     `json:"width"`
+	Height          int     `json:"height"`
+	SDModelName     string  `json:"sd_model_name"`
+	SDModelHash     string  `json:"sd_model_hash"`
+
+	Prompt         string `json:"prompt"`
+	NegativePrompt string `json:"negative_prompt"`
+	// InfoTexts are parameters of each image in format of WebUI.
+	InfoTexts []string `json:"infotexts"`
+}
+
+// parseInfo parses info of response, which may be a json encoded string or an object.
+func parseInfo(raw json.RawMessage) *generationInfo {
+	if len(raw) == 0 {
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		raw = json.RawMessage(s)
+	}
+	info := &generationInfo{}
+	if err := json.Unmarshal(raw, info); err != nil {
+		log.Error("unmarshal stable diffusion info failed", zap.Error(err))
+		return nil
+	}
+	return info
+}
+
+// seedAt returns seed and subseed of the i-th image.
+func (info *generationInfo) seedAt(i int) (seed, subseed int64) {
+	seed, subseed = info.Seed, info.Subseed
+	if i < len(info.AllSeeds) {
+		seed = info.AllSeeds[i]
+	}
+	if i < len(info.AllSubseeds) {
+		subseed = info.AllSubseeds[i]
+	}
+	return seed, subseed
+}
+
+// parameters returns parameters of the i-th image in format of WebUI, which can be read by PNG Info tab.
+func (info *generationInfo) parameters(i int) string {
+	if i < len(info.InfoTexts) && info.InfoTexts[i] != "" {
+		return info.InfoTexts[i]
+	}
+
+	seed, subseed := info.seedAt(i)
+	var sb strings.Builder
+	sb.WriteString(info.Prompt)
+	if info.NegativePrompt != "" {
+		sb.WriteString("\nNegative prompt: " + info.NegativePrompt)
+	}
+	sb.WriteString(fmt.Sprintf("\nSteps: %d, Sampler: %s, CFG scale: %g, Seed: %d, Size: %dx%d",
+		info.Steps, info.Sampler, info.CfgScale, seed, info.Width, info.Height))
+	if info.SDModelHash != "" {
+		sb.WriteString(", Model hash: " + info.SDModelHash)
+	}
+	if info.SDModelName != "" {
+		sb.WriteString(", Model: " + info.SDModelName)
+	}
+	if info.SubseedStrength > 0 {
+		sb.WriteString(fmt.Sprintf(", Variation seed: %d, Variation seed strength: %g", subseed, info.SubseedStrength))
+	}
+	return sb.String()
+}
+
+// caption returns generation info shown under images.
+func (info *generationInfo) caption() string {
+	seeds := make([]string, 0, len(info.AllSeeds))
+	for _, seed := range info.AllSeeds {
+		seeds = append(seeds, strconv.FormatInt(seed, 10))
+	}
+	if len(seeds) == 0 {
+		seeds = append(seeds, strconv.FormatInt(info.Seed, 10))
+	}
+
+	var sb strings.Builder
+	sb.WriteString("seed: " + strings.Join(seeds, ", ") + "\n")
+	if info.SubseedStrength > 0 {
+		sb.WriteString(fmt.Sprintf("variation: %d (%.2f)\n", info.Subseed, info.SubseedStrength))
+	}
+	sb.WriteString(fmt.Sprintf("sampler: %s, steps: %d, cfg: %g, size: %dx%d",
+		info.Sampler, info.Steps, info.CfgScale, info.Width, info.Height))
+	if info.SDModelName != "" || info.SDModelHash != "" {
+		sb.WriteString(fmt.Sprintf("\nmodel: %s (%s)", info.SDModelName, info.SDModelHash))
+	}
+	return sb.String()
+}
+
+// sdResult is the request of a generated image, which can be rerun by /sdredo.
+// For message of action buttons, it's the request of job, and Seed is seed of the first image.
+type sdResult struct {
+	// Request has no init images, which is downloaded by InitFileID when rerun.
+	Request    StableDiffusionReq `json:"request"`
+	InitFileID string             `json:"init_file_id,omitempty"`
+
+	Seed int64 `json:"seed,omitempty"`
+	// PhotoFileIDs are file ids of result images, which are documents if photos are not sent.
+	PhotoFileIDs []string `json:"photo_file_ids,omitempty"`
+}
+
+// saveResults saves request with seed of each image, so that every image can be rerun.
+func saveResults(job *StableDiffusionContext, info *generationInfo, msgs []Message) {
+	for i := range msgs {
+		result := sdResult{Request: job.Request, InitFileID: job.InitFileID}
+		result.Request.Seed, result.Request.Subseed = info.seedAt(i)
+		result.Request.SubseedStrength = info.SubseedStrength
+		data, err := json.Marshal(result)
+		if err != nil {
+			log.Error("marshal stable diffusion result failed", zap.Error(err))
+			return
+		}
+		_ = orm.SetSDResult(msgs[i].Chat.ID, msgs[i].ID, string(data), resultRetention)
+	}
+}
+
+func loadResult(chatID int64, msgID int) (*sdResult, error) {
+	data, err := orm.GetSDResult(chatID, msgID)
+	if err != nil {
+		return nil, err
+	}
+	result := &sdResult{}
+	if err = json.Unmarshal([]byte(data), result); err != nil {
+		log.Error("unmarshal stable diffusion result failed", zap.Error(err))
+		return nil, err
+	}
+	return result, nil
+}
+
+// RedoHandler handle /sdredo command, reply to a result to rerun it with the same seed,
+// or `/sdredo <strength>` for variations of it.
+func RedoHandler(ctx Context) error {
+	replyTo := ctx.Message().ReplyTo
+	if replyTo == nil {
+		return ctx.Reply("回复一张画出来的图试试，`/sdredo` 用同样的种子重画，`/sdredo 0.3` 画一些变体", ModeMarkdownV2)
+	}
+	result, err := loadResult(ctx.Chat().ID, replyTo.ID)
+	if errors.Is(err, redis.Nil) {
+		return ctx.Reply("这张图的信息已经找不到了")
+	}
+	if err != nil {
+		return ctx.Reply("完了，删库跑路了")
+	}
+
+	command := entities.FromMessage(ctx.Message())
+	req := result.Request
+	req.BatchSize = 1
+	if command.Argc() > 0 {
+		strength, err := strconv.ParseFloat(command.Arg(0), 64)
+		if err != nil || strength <= 0 || strength > 1 {
+			return ctx.Reply("变化强度需要在 0 到 1 之间")
+		}
+		req.Subseed = -1
+		req.SubseedStrength = strength
+	}
+
+	config, err := getConfigByUserID(ctx.Sender().ID)
+	if err != nil {
+		return ctx.Reply("完了，删库跑路了")
+	}
+	if config.GetServer() == "" && !pool.available() {
+		return ctx.Reply("喂喂喂，你还没有配置服务器好吧。" +
+			"快使用 /sdcfg 配置一个属于自己的服务器，或者找好心人捐赠一个服务器吧")
+	}
+	if command.Argc() > 0 && !req.HiResEnabled {
+		req.BatchSize = config.GetValueByKey("number").(int)
+	}
+
+	return submit(ctx, &StableDiffusionContext{
+		UserConfig: *config,
+		Request:    req,
+		InitFileID: result.InitFileID,
+	})
+}
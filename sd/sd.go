@@ -9,27 +9,23 @@ import (
 	"csust-got/util"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/quic-go/quic-go"
+	"github.com/redis/go-redis/v9"
 
 	"github.com/quic-go/quic-go/http3"
 	"go.uber.org/zap"
 	. "gopkg.in/telebot.v3"
 )
 
-var (
-	mu       sync.Mutex
-	ch       = make(chan *StableDiffusionContext, 10)
-	busyUser = make(map[int64]int)
-)
-
 var httpClient *http.Client
 
 type mixRoundTripper struct {
@@ -78,13 +74,8 @@ func init() {
 	}
 }
 
-// Handler stable diffusion handler.
+// Handler stable diffusion handler, reply to a photo to use img2img.
 func Handler(ctx Context) error {
-	if !mu.TryLock() {
-		return ctx.Reply("忙不过来了")
-	}
-	defer mu.Unlock()
-
 	command := entities.FromMessage(ctx.Message())
 
 	userID := ctx.Sender().ID
@@ -93,135 +84,252 @@ func Handler(ctx Context) error {
 		return ctx.Reply("完了，删库跑路了")
 	}
 
-	if config.GetServer() == "" {
+	prompt := command.ArgAllInOneFrom(0)
+	if name := command.Arg(0); strings.HasPrefix(name, "@") {
+		config, err = profileConfig(userID, name[1:], config)
+		if errors.Is(err, redis.Nil) {
+			return ctx.Reply(fmt.Sprintf("没有配置 %s，用 /sdcfg profile list 看看有哪些配置吧", name[1:]))
+		}
+		if err != nil {
+			return ctx.Reply("完了，删库跑路了")
+		}
+		prompt = command.ArgAllInOneFrom(1)
+	}
+
+	if config.GetServer() == "" && !pool.available() {
 		return ctx.Reply("喂喂喂，你还没有配置服务器好吧。" +
 			"快使用 /sdcfg 配置一个属于自己的服务器，或者找好心人捐赠一个服务器吧")
 	}
 
-	prompt := command.ArgAllInOneFrom(0)
+	initFile := replyImage(ctx.Message())
+	if initFile != nil && initFile.FileSize > maxInitImageSize {
+		return ctx.Reply("图太大了，改不动")
+	}
+
 	prompt = strings.ReplaceAll(prompt, "，", ",")
 	if prompt == "" {
+		// last prompt has been translated
 		prompt, _ = orm.GetSDLastPrompt(userID)
-	} else {
+	}
+	translate := config.GetValueByKey("translate").(string) == "on" && needTranslate(prompt)
+	if !translate {
 		_ = orm.SetSDLastPrompt(userID, prompt)
 	}
 
 	req := config.GenStableDiffusionRequest()
-	req.Prompt += ", " + prompt
-
-	if busyUser[userID] >= 3 {
-		return ctx.Reply("听我说你先别急，你还有3个没画完")
-	}
-
-	select {
-	case ch <- &StableDiffusionContext{
-		BotContext: ctx,
-		UserConfig: *config,
-		Request:    *req,
-	}:
-		busyUser[userID]++
-		msg := "在画了在画了"
-		if req.HiResEnabled {
-			msg += "，高清修复已开启，可能会比较慢，耐心等待一下~"
+	job := &StableDiffusionContext{UserConfig: *config}
+	if translate {
+		// prompt is translated when job runs, so that it can be canceled and queue limits are checked first
+		job.TranslatePrompt = prompt
+	} else {
+		req.Prompt += ", " + prompt
+	}
+	if initFile != nil {
+		req.DenoisingStrength = config.GetValueByKey("denoising_strength").(float64)
+		req.HiResEnabled = false
+		job.InitFileID = initFile.FileID
+	}
+	job.Request = *req
+	return submit(ctx, job)
+}
+
+// submit adds job to queue, and replies a status message which shows progress of job.
+func submit(ctx Context, job *StableDiffusionContext) error {
+	job.ChatID, job.UserID, job.MsgID = ctx.Chat().ID, ctx.Sender().ID, ctx.Message().ID
+	if err := sched.check(job.UserID); err != nil {
+		return ctx.Reply(queueErrorMessage(err))
+	}
+
+	msg := "在画了在画了"
+	switch {
+	case job.Request.Upscale > 0:
+		msg = "在放大了在放大了"
+	case job.InitFileID != "":
+		msg = "在改了在改了"
+	}
+	if job.Request.HiResEnabled {
+		msg += "，高清修复已开启，可能会比较慢，耐心等待一下~"
+	}
+	status, err := ctx.Bot().Reply(ctx.Message(), msg)
+	if err != nil {
+		log.Error("reply stable diffusion status failed", zap.Error(err))
+	} else {
+		job.StatusMsgID = status.ID
+	}
+
+	if err = sched.push(job); err != nil {
+		if status != nil {
+			_, _ = ctx.Bot().Edit(status, queueErrorMessage(err))
+			return nil
 		}
-		return ctx.Reply(msg)
-	default:
-		return ctx.Reply("忙不过来了")
+		return ctx.Reply(queueErrorMessage(err))
 	}
+	return nil
+}
 
+func queueErrorMessage(err error) string {
+	switch {
+	case errors.Is(err, ErrTooManyJobs):
+		return fmt.Sprintf("听我说你先别急，你还有%d个没画完", maxUserJobs)
+	case errors.Is(err, ErrQueueFull):
+		return "任务堆积太多，忙不过来了。"
+	}
+	return "完了，删库跑路了"
 }
 
-// Process is the stable diffusion background worker.
+// Process is the stable diffusion background worker, it resumes unfinished jobs,
+// and runs jobs in queue once there are idle servers for them.
 func Process() {
-	lock := new(sync.Mutex)
-	inUsedServer := make(map[string]chan *StableDiffusionContext)
-	maxWorker := make(chan struct{}, 10)
-
-	for ctx := range ch {
-		select {
-		case maxWorker <- struct{}{}:
-			// Do nothing
-		default:
-			err := ctx.BotContext.Reply("任务堆积太多，忙不过来了。")
-			if err != nil {
-				log.Error("reply error", zap.Error(err))
-			}
-			continue
+	go pool.healthCheck()
+
+	sched.restore()
+	for {
+		go process(sched.pop())
+	}
+}
+
+// process runs job on server, which is reserved for job, err is not nil if job can't run on any server.
+func process(job *StableDiffusionContext, server *sdServer, err error) {
+	if err != nil {
+		sched.finish(job, jobFailed)
+		replyJob(job, "服务器都寄了，等会再试试吧")
+		return
+	}
+
+	if job.TranslatePrompt != "" {
+		translateJob(job)
+		if job.ctx.Err() != nil {
+			// canceled, status message has been edited
+			pool.free(server)
+			return
 		}
+	}
 
-		ctx := ctx
-		server := ctx.UserConfig.GetServer()
+	req := job.Request
+	fileIDs := job.UpscaleFileIDs
+	if job.InitFileID != "" {
+		fileIDs = []string{job.InitFileID}
+	}
+	for _, id := range fileIDs {
+		initImage, err := downloadImage(&File{FileID: id})
+		if err != nil {
+			log.Error("download init image failed", zap.Int64("job", job.ID), zap.Error(err))
+			pool.free(server)
+			sched.finish(job, jobFailed)
+			replyJob(job, "图片下载失败了")
+			return
+		}
+		req.InitImages = append(req.InitImages, initImage)
+	}
 
-		lock.Lock()
-		serverCh, ok := inUsedServer[server]
-		if !ok {
-			serverCh = make(chan *StableDiffusionContext, 10)
-			inUsedServer[ctx.UserConfig.GetServer()] = serverCh
+	r := newProgressReporter(job)
+	resp, err := runOn(job.ctx, server, &req, r)
+	if job.ctx.Err() != nil {
+		// canceled, status message has been edited
+		return
+	}
+	if errors.Is(err, ErrServerNotAvailable) && server.pooled && job.UserConfig.Server == "" {
+		log.Warn("stable diffusion server not available, try another one", zap.String("server", server.addr), zap.Error(err))
+		sched.retry(job, server.addr)
+		return
+	}
+	r.finish()
+	if err != nil {
+		sched.finish(job, jobFailed)
+		replyJob(job, "寄了")
+		return
+	}
+
+	if req.Upscale > 0 {
+		sendUpscaled(job, resp.Images)
+		return
+	}
+
+	info := parseInfo(resp.Info)
+	format := job.UserConfig.GetValueByKey("format").(string)
+	photos, documents := Album{}, Album{}
+	for i, v := range resp.Images {
+		data, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			log.Error("decode stable diffusion image failed", zap.Error(err))
+			continue
+		}
+		if info != nil {
+			data = withParameters(data, info.parameters(i))
+		}
+		if format != "document" {
+			photos = append(photos, &Photo{File: FromReader(bytes.NewReader(data))})
 		}
-		lock.Unlock()
-		serverCh <- ctx
-
-		processFn := func() {
-			for {
-				select {
-				case ctx := <-serverCh:
-					func() {
-						ctx := ctx
-						defer func() {
-							<-maxWorker
-
-							mu.Lock()
-							busyUser[ctx.BotContext.Sender().ID]--
-							mu.Unlock()
-						}()
-						resp, err := requestStableDiffusion(ctx.UserConfig.GetServer(), &ctx.Request)
-						if err != nil {
-							err := ctx.BotContext.Reply("寄了")
-							if err != nil {
-								log.Error("reply stable diffusion failed", zap.Error(err))
-							}
-							return
-						}
-
-						photos := Album{}
-						for _, v := range resp.Images {
-							data, err := base64.StdEncoding.DecodeString(v)
-							if err != nil {
-								log.Error("decode stable diffusion image failed", zap.Error(err))
-								continue
-							}
-							photos = append(photos, &Photo{
-								File: File{FileReader: bytes.NewReader(data)},
-							})
-						}
-
-						err = ctx.BotContext.SendAlbum(photos)
-						if err != nil {
-							log.Error("send stable diffusion album failed", zap.Error(err))
-							err = ctx.BotContext.Reply("非常的寄")
-							if err != nil {
-								log.Error("reply stable diffusion failed", zap.Error(err))
-							}
-							return
-						}
-					}()
-				default:
-					lock.Lock()
-					if len(serverCh) == 0 {
-						delete(inUsedServer, server)
-						lock.Unlock()
-						return
-					}
-					lock.Unlock()
-				}
-			}
+		if format != "photo" {
+			// document is sent as is, so that parameters in png are kept
+			documents = append(documents, &Document{
+				File:     FromReader(bytes.NewReader(data)),
+				FileName: fmt.Sprintf("%d-%d.png", job.ID, i+1),
+				MIME:     "image/png",
+			})
 		}
+	}
 
-		if !ok {
-			go processFn()
+	// actions and results are bound to photos if they are sent
+	album := photos
+	if len(album) == 0 {
+		album = documents
+	}
+	if len(album) > 0 && info != nil {
+		switch media := album[0].(type) {
+		case *Photo:
+			media.Caption = info.caption()
+		case *Document:
+			media.Caption = info.caption()
 		}
 	}
 
+	msgs, err := job.sendAlbum(album)
+	if err == nil && len(photos) > 0 && len(documents) > 0 {
+		_, err = job.sendAlbum(documents)
+	}
+	if err != nil {
+		log.Error("send stable diffusion album failed", zap.Error(err))
+		sched.finish(job, jobFailed)
+		replyJob(job, "非常的寄")
+		return
+	}
+	sched.finish(job, jobDone)
+	if info != nil {
+		saveResults(job, info, msgs)
+		sendActions(job, info, msgs)
+		addHistory(job, info, msgs)
+	}
+}
+
+// sendUpscaled sends upscaled images as files, otherwise they are compressed.
+func sendUpscaled(job *StableDiffusionContext, images []string) {
+	documents := Album{}
+	for i, v := range images {
+		data, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			log.Error("decode stable diffusion image failed", zap.Error(err))
+			continue
+		}
+		documents = append(documents, &Document{
+			File:     FromReader(bytes.NewReader(data)),
+			FileName: fmt.Sprintf("upscaled-%d.png", i+1),
+			MIME:     "image/png",
+		})
+	}
+	if _, err := job.sendAlbum(documents); err != nil {
+		log.Error("send stable diffusion album failed", zap.Error(err))
+		sched.finish(job, jobFailed)
+		replyJob(job, "非常的寄")
+		return
+	}
+	sched.finish(job, jobDone)
+}
+
+func replyJob(job *StableDiffusionContext, msg string) {
+	if _, err := job.reply(msg); err != nil {
+		log.Error("reply stable diffusion failed", zap.Error(err))
+	}
 }
 
 /*
@@ -269,11 +377,60 @@ type StableDiffusionReq struct {
 	BatchSize      int    `json:"batch_size"`
 	SamplerIndex   string `json:"sampler_index"`
 
+	Seed            int64   `json:"seed"`
+	Subseed         int64   `json:"subseed"`
+	SubseedStrength float64 `json:"subseed_strength"`
+
+	// OverrideSettings overrides options of WebUI for this request, such as `sd_model_checkpoint`.
+	OverrideSettings map[string]interface{} `json:"override_settings,omitempty"`
+
 	HiResEnabled         bool    `json:"enable_hr"`
 	DenoisingStrength    float64 `json:"denoising_strength"`
 	HiResScale           float64 `json:"hr_scale"`
 	HiResUpscaler        string  `json:"hr_upscaler"`
 	HiResSecondPassSteps int     `json:"hr_second_pass_steps"`
+
+	// InitImages are base64 encoded images for img2img.
+	InitImages []string `json:"init_images,omitempty"`
+
+	// Upscale is the scale of upscaling init images, it's not a generation if set.
+	Upscale float64 `json:"upscale,omitempty"`
+}
+
+// extrasReq is the request body of `/sdapi/v1/extra-batch-images`.
+type extrasReq struct {
+	ResizeMode      int           `json:"resize_mode"`
+	UpscalingResize float64       `json:"upscaling_resize"`
+	Upscaler        string        `json:"upscaler_1"`
+	ImageList       []extrasImage `json:"imageList"`
+}
+
+type extrasImage struct {
+	Data string `json:"data"`
+	Name string `json:"name"`
+}
+
+// api returns the api path of request, img2img is used if there are init images.
+func (r *StableDiffusionReq) api() string {
+	switch {
+	case r.Upscale > 0:
+		return "/sdapi/v1/extra-batch-images"
+	case len(r.InitImages) > 0:
+		return "/sdapi/v1/img2img"
+	}
+	return "/sdapi/v1/txt2img"
+}
+
+// body returns the request body of api.
+func (r *StableDiffusionReq) body() interface{} {
+	if r.Upscale == 0 {
+		return r
+	}
+	body := &extrasReq{UpscalingResize: r.Upscale, Upscaler: upscaler}
+	for i, image := range r.InitImages {
+		body.ImageList = append(body.ImageList, extrasImage{Data: image, Name: strconv.Itoa(i) + ".png"})
+	}
+	return body
 }
 
 /*
@@ -353,22 +510,24 @@ type StableDiffusionReq struct {
 // StableDiffusionResp is the response of stable diffusion
 type StableDiffusionResp struct {
 	Images []string `json:"images"`
+	// Info is generation info, which is a json encoded string.
+	Info json.RawMessage `json:"info"`
 }
 
-func requestStableDiffusion(addr string, req *StableDiffusionReq) (*StableDiffusionResp, error) {
+func requestStableDiffusion(ctx context.Context, addr string, req *StableDiffusionReq) (*StableDiffusionResp, error) {
 	if addr == "" {
 		return nil, ErrServerNotConfigured
 	}
 
-	bs, err := json.Marshal(req)
+	bs, err := json.Marshal(req.body())
 	if err != nil {
 		log.Error("marshal stable diffusion request failed", zap.Error(err))
 		return nil, err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Minute)
 	defer cancel()
-	httpReq, err := http.NewRequest("POST", addr+"/sdapi/v1/txt2img", bytes.NewReader(bs))
+	httpReq, err := http.NewRequest("POST", addr+req.api(), bytes.NewReader(bs))
 	if err != nil {
 		log.Error("create stable diffusion request failed", zap.Error(err))
 		return nil, err
@@ -378,6 +537,9 @@ func requestStableDiffusion(addr string, req *StableDiffusionReq) (*StableDiffus
 	// httpReq.Header.Set("Expect", "100-continue")
 
 	resp, err := httpClient.Do(httpReq)
+	if errors.Is(err, context.Canceled) {
+		return nil, err
+	}
 	if err != nil {
 		log.Error("request stable diffusion failed", zap.Error(err))
 		return nil, fmt.Errorf("request stable diffusion failed: %w", ErrServerNotAvailable)
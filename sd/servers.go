@@ -0,0 +1,77 @@
+package sd
+
+import (
+	"csust-got/config"
+	"csust-got/entities"
+	"csust-got/orm"
+	"fmt"
+	"strconv"
+	"strings"
+
+	. "gopkg.in/telebot.v3"
+)
+
+const serversHelpInfo = "sdservers\n" +
+	"sdservers add \\<server\\> \\[weight\\]\n" +
+	"sdservers rm \\<server\\>\n" +
+	"only admin can add or remove server, jobs are dispatched to idle healthy servers, and servers with higher weight are preferred\\."
+
+// ServersHandler handle /sdservers command, list status of server pool, or manage it by admin.
+func ServersHandler(ctx Context) error {
+	command := entities.FromMessage(ctx.Message())
+	isAdmin := config.BotConfig.SDConfig.IsAdmin(ctx.Sender().ID)
+	if command.Argc() == 0 {
+		// address of server is secret, only show it to admin in private chat
+		return ctx.Reply(pool.status(isAdmin && ctx.Chat().Type == ChatPrivate))
+	}
+
+	if !isAdmin {
+		return ctx.Reply("只有管理员才能管理服务器哦")
+	}
+	if command.Argc() < 2 {
+		return ctx.Reply(serversHelpInfo, ModeMarkdownV2)
+	}
+
+	addr := strings.TrimSuffix(command.Arg(1), "/")
+	switch command.Arg(0) {
+	case "add":
+		if !strings.HasPrefix(addr, "http://") && !strings.HasPrefix(addr, "https://") {
+			return ctx.Reply("服务器地址需要以 http:// 或 https:// 开头")
+		}
+		weight := 1
+		if command.Argc() > 2 {
+			w, err := strconv.Atoi(command.Arg(2))
+			if err != nil || w < 1 || w > 100 {
+				return ctx.Reply("权重需要是 1 到 100 之间的整数")
+			}
+			weight = w
+		}
+		if err := orm.SetSDServer(addr, weight); err != nil {
+			return ctx.Reply("完了，删库跑路了")
+		}
+		if err := pool.load(); err != nil {
+			return ctx.Reply("完了，删库跑路了")
+		}
+		// server is healthy until checked, probe it now so that jobs are not sent to a dead server
+		if s := pool.server(addr); s != nil {
+			if err := pool.probe(s); err != nil {
+				return ctx.Reply(fmt.Sprintf("服务器已添加，但是现在连不上: %s", err.Error()))
+			}
+		}
+		return ctx.Reply("服务器已添加")
+	case "rm":
+		ok, err := orm.DelSDServer(addr)
+		if err != nil {
+			return ctx.Reply("完了，删库跑路了")
+		}
+		if !ok {
+			return ctx.Reply("服务器池里没有这个服务器")
+		}
+		// server is not picked any more, running jobs on it are kept
+		if err := pool.load(); err != nil {
+			return ctx.Reply("完了，删库跑路了")
+		}
+		return ctx.Reply("服务器已移除")
+	}
+	return ctx.Reply(serversHelpInfo, ModeMarkdownV2)
+}
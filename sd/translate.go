@@ -0,0 +1,45 @@
+package sd
+
+import (
+	"csust-got/chat"
+	"csust-got/log"
+	"csust-got/orm"
+	"errors"
+	"unicode"
+
+	"go.uber.org/zap"
+)
+
+// needTranslate returns true if prompt has non-ASCII characters, English prompt is sent as is.
+func needTranslate(prompt string) bool {
+	for _, r := range prompt {
+		if r > unicode.MaxASCII {
+			return true
+		}
+	}
+	return false
+}
+
+// translateJob translates prompt of job into English tags by LLM, and replies the result so that user can learn from it.
+// The original prompt is used if translation fails. The result is saved as last prompt, so it's not translated again.
+func translateJob(job *StableDiffusionContext) {
+	prompt := job.TranslatePrompt
+	translated, err := chat.TranslatePrompt(job.ctx, job.ChatID, job.UserID, prompt)
+	switch {
+	case job.ctx.Err() != nil:
+		return
+	case errors.Is(err, chat.ErrQuotaExceeded):
+		replyJob(job, "额度用完了，直接用原文画吧")
+	case err != nil || translated == "":
+		log.Error("translate stable diffusion prompt failed", zap.Int64("job", job.ID), zap.Error(err))
+		replyJob(job, "翻译失败了，直接用原文画吧")
+	default:
+		prompt = translated
+		replyJob(job, "prompt 翻译成了：\n"+translated)
+	}
+	job.Request.Prompt += ", " + prompt
+	job.TranslatePrompt = ""
+	// job is not translated again if it's restored after restart
+	sched.update(job)
+	_ = orm.SetSDLastPrompt(job.UserID, prompt)
+}
@@ -118,6 +118,17 @@ func CanRestrictMembers(chat *tb.Chat, user *tb.User) bool {
 	return member.CanRestrictMembers
 }
 
+// IsChatAdmin can check if someone is admin or creator of chat.
+func IsChatAdmin(chat *tb.Chat, user *tb.User) bool {
+	member, err := config.BotConfig.Bot.ChatMemberOf(chat, user)
+	if err != nil {
+		log.Error("can get IsChatAdmin", zap.Int64("chatID", chat.ID),
+			zap.Int64("userID", user.ID), zap.Error(err))
+		return false
+	}
+	return member.Role == tb.Administrator || member.Role == tb.Creator
+}
+
 // GetChatMember can get chat member from chat.
 // func GetChatMember(bot *tgbotapi.BotAPI, chatID int64, userID int) ChatMember {
 // 	chatMember, err := bot.GetChatMember(tgbotapi.ChatConfigWithUser{